@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+
+	loginRegexp = regexp.MustCompile(`^[a-z0-9_]{4,30}$`)
+)
+
+// WritableUserStore is a UserStore accounts can be added to and changed.
+type WritableUserStore interface {
+	UserStore
+	Exists(login string) bool
+	Create(login, password, email string) error
+	SetPassword(login, password string) error
+}
+
+// Account is a user of a FileUserStore, only the bcrypt hash of the
+// password is kept.
+type Account struct {
+	Login     string    `json:"login"`
+	Email     string    `json:"email,omitempty"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func validateLogin(login string) error {
+	if !loginRegexp.MatchString(login) {
+		return fmt.Errorf("invalid username %q, use 4 to 30 lowercase letters, digits or underscores", login)
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if isAccessToken(password) {
+		return errors.New("password can't look like an access token")
+	}
+	return nil
+}
+
+// FileUserStore keeps each account as a file named by its login under Dir.
+type FileUserStore struct {
+	Dir string
+}
+
+func NewFileUserStore(dir string) *FileUserStore {
+	return &FileUserStore{Dir: dir}
+}
+
+func (s *Store) Users() *FileUserStore {
+	return NewFileUserStore(s.Dir + "/_users")
+}
+
+func (s *FileUserStore) path(login string) string {
+	return filepath.Join(s.Dir, login)
+}
+
+func (s *FileUserStore) account(login string) (*Account, error) {
+	if validateLogin(login) != nil {
+		return nil, ErrUserNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(login))
+	if os.IsNotExist(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	account := &Account{}
+	return account, json.Unmarshal(data, account)
+}
+
+func (s *FileUserStore) Auth(login, password string) bool {
+	account, err := s.account(login)
+	if err != nil {
+		if err != ErrUserNotFound {
+			logger.Errorf("reading account %s %s", login, err)
+		}
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(account.Hash), []byte(password)) == nil
+}
+
+func (s *FileUserStore) Exists(login string) bool {
+	_, err := s.account(login)
+	return err == nil
+}
+
+// Logins returns the login of every account.
+func (s *FileUserStore) Logins() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	logins := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && validateLogin(info.Name()) == nil {
+			logins = append(logins, info.Name())
+		}
+	}
+	sort.Strings(logins)
+	return logins, nil
+}
+
+func (s *FileUserStore) Create(login, password, email string) error {
+	if err := validateLogin(login); err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockPath(s.path(login))
+	defer unlock()
+
+	if s.Exists(login) {
+		return ErrUserExists
+	}
+	now := time.Now()
+	return s.write(&Account{Login: login, Email: email, Hash: string(hash), CreatedAt: now, UpdatedAt: now})
+}
+
+func (s *FileUserStore) SetPassword(login, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockPath(s.path(login))
+	defer unlock()
+
+	account, err := s.account(login)
+	if err != nil {
+		return err
+	}
+	account.Hash, account.UpdatedAt = string(hash), time.Now()
+	return s.write(account)
+}
+
+// write replaces the account's file, the caller holds its lock.
+func (s *FileUserStore) write(account *Account) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	tmpName, _, err := writeTemp(s.path(account.Login), nopCloser(data))
+	if err != nil {
+		return err
+	}
+	return commitTemp(tmpName, s.path(account.Login))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func (t *testSuite) TestFileUserStore() {
+	users := (&Store{resetTmpDataDir()}).Users()
+
+	t.Nil(users.Create("mark", "password1", "mark@example.com"))
+	t.True(users.Exists("mark"))
+	t.True(users.Auth("mark", "password1"))
+	t.False(users.Auth("mark", "password2"))
+	t.False(users.Auth("tim", "password1"))
+	t.Equal(ErrUserExists, users.Create("mark", "password2", ""))
+
+	t.True(users.Create("Mark!", "password1", "") != nil)
+	t.True(users.Create("timothy", "short", "") != nil)
+
+	// only the hash is stored
+	data, _ := ioutil.ReadFile(users.Dir + "/mark")
+	t.False(bytes.Contains(data, []byte("password1")))
+
+	t.Nil(users.SetPassword("mark", "password2"))
+	t.True(users.Auth("mark", "password2"))
+	t.False(users.Auth("mark", "password1"))
+	t.Equal(ErrUserNotFound, users.SetPassword("tim", "password2"))
+}
+
+func (t *testSuite) TestUserAccounts() {
+	store := &Store{resetTmpDataDir()}
+	auth := NewBasicAuth(store.Users(), "secret")
+	h := NewHandler(store.Dir, "dynport", auth)
+	h.OpenRegistration = true
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path, login, password, body string) (int, string) {
+		req, _ := http.NewRequest(method, ser.URL+path, strings.NewReader(body))
+		if login != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(login+":"+password)))
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		defer rsp.Body.Close()
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(data)
+	}
+
+	status, body := do("POST", "/v1/users/", "", "", `{"username": "markus", "password": "password1", "email": "mark@example.com"}`)
+	t.Equal(201, status)
+	t.Equal(`"User Created"`, body)
+
+	// docker login goes on to check the credentials when told this
+	status, body = do("POST", "/v1/users/", "", "", `{"username": "markus", "password": "password1", "email": "mark@example.com"}`)
+	t.Equal(400, status)
+	t.Equal(`"Username or email already exists"`, body)
+	status, _ = do("POST", "/v1/users/", "", "", `{"username": "x", "password": "password1"}`)
+	t.Equal(400, status)
+
+	status, _ = do("GET", "/v1/users/", "markus", "password1", "")
+	t.Equal(200, status)
+	status, _ = do("GET", "/v1/users/", "markus", "wrong", "")
+	t.Equal(401, status)
+	status, _ = do("GET", "/v1/users/", "", "", "")
+	t.Equal(401, status)
+
+	// registering doesn't make anyone an admin
+	status, _ = do("GET", "/v1/_admin/quotas", "markus", "password1", "")
+	t.Equal(403, status)
+
+	session, err := auth.CheckAuth(basicAuthRequest("markus", "password1"))
+	t.Nil(err)
+	do("POST", "/v1/users/", "", "", `{"username": "timothy", "password": "password1"}`)
+	status, _ = do("PUT", "/v1/users/markus/", "timothy", "password1", `{"password": "password2"}`)
+	t.Equal(403, status)
+	status, _ = do("PUT", "/v1/users/markus/", "markus", "password1", `{"password": "short"}`)
+	t.Equal(400, status)
+	status, _ = do("PUT", "/v1/users/markus/", "markus", "password1", `{"password": "password2"}`)
+	t.Equal(204, status)
+
+	status, _ = do("GET", "/v1/users/", "markus", "password1", "")
+	t.Equal(401, status)
+	status, _ = do("GET", "/v1/users/", "markus", "password2", "")
+	t.Equal(200, status)
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestClosedRegistration() {
+	store := &Store{resetTmpDataDir()}
+	h := NewHandler(store.Dir, "dynport", NewBasicAuth(store.Users(), "secret"))
+	h.Admins = []string{"admin"}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	commandInput = strings.NewReader("adminpass\n")
+	t.Nil(runCommand(store, &bytes.Buffer{}, []string{"user", "add", "admin"}))
+
+	post := func(login, password string) int {
+		req, _ := http.NewRequest("POST", ser.URL+"/v1/users/", strings.NewReader(`{"username": "markus", "password": "password1"}`))
+		if login != "" {
+			req.SetBasicAuth(login, password)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(401, post("", ""))
+	t.Equal(201, post("admin", "adminpass"))
+	t.True(store.Users().Auth("markus", "password1"))
+
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(store, out, []string{"users", "list"}))
+	t.Equal("admin\nmarkus\n", out.String())
+}
+
+func (t *testSuite) TestNoAdminsWithFileUserStore() {
+	store := &Store{resetTmpDataDir()}
+	h := NewHandler(store.Dir, "dynport", NewBasicAuth(store.Users(), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	users := store.Users()
+	t.Nil(users.Create("alice", "password1", ""))
+	t.Nil(users.Create("mallory", "password1", ""))
+
+	do := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, ser.URL+path, strings.NewReader(body))
+		req.SetBasicAuth("mallory", "password1")
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// without admins listed nobody is one
+	t.Equal(403, do("PUT", "/v1/users/alice/", `{"password": "password2"}`))
+	t.True(users.Auth("alice", "password1"))
+	t.Equal(403, do("GET", "/v1/_admin/quotas", ""))
+	t.Equal(401, do("POST", "/v1/users/", `{"username": "markus", "password": "password1"}`))
+	t.Equal(403, do("POST", "/v1/_tokens", `{"name": "builder", "robot": true, "scopes": [{"repositories": "*", "access": "push"}]}`))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// how long a cached tag map outlives the last change to its repository
+	tagCacheTTL = 10 * time.Minute
+	// image json is written once, but quarantined images may come back
+	ancestryCacheTTL = time.Hour
+	// a tags directory changed more recently than this isn't cached, the
+	// directory's modification time can miss changes made in quick succession
+	tagCacheSettle = time.Second
+)
+
+// cachedTags returns the tags of repo from the handler's cache when the
+// repository's tags haven't changed since they were cached. The cache is
+// keyed by the modification time of the tags directory, which every tag
+// write, move or removal updates, so nothing has to invalidate it.
+func (h *Handler) cachedTags(repo *Repository) map[string]string {
+	info, err := os.Stat(repo.Dir + "/tags")
+	if err != nil || time.Since(info.ModTime()) < tagCacheSettle {
+		return repo.Tags()
+	}
+
+	key := fmt.Sprintf("tags:%s:%d", repo.Dir, info.ModTime().UnixNano())
+	tags := map[string]string{}
+	if h.cacheGet(key, &tags) {
+		return tags
+	}
+
+	tags = repo.Tags()
+	h.cacheSet(key, tags, tagCacheTTL)
+	return tags
+}
+
+// cachedAncestry returns the ancestry chain of image, only complete chains
+// are cached.
+func (h *Handler) cachedAncestry(image *Image) ([]string, error) {
+	key := "ancestry:" + image.Id()
+	ancestry := []string{}
+	if h.cacheGet(key, &ancestry) {
+		return ancestry, nil
+	}
+
+	ancestry, err := image.AncestryChain()
+	if err != nil {
+		return ancestry, err
+	}
+	h.cacheSet(key, ancestry, ancestryCacheTTL)
+	return ancestry, nil
+}
+
+// cacheGet decodes the value cached under key into v, a cache which can't
+// be reached is treated as a miss.
+func (h *Handler) cacheGet(key string, v interface{}) bool {
+	data, ok, err := h.Cache.Get(key)
+	if err != nil {
+		logger.Errorf("reading cache %s", err)
+		return false
+	}
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+func (h *Handler) cacheSet(key string, v interface{}, ttl time.Duration) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = h.Cache.Set(key, data, ttl)
+	}
+	if err != nil {
+		logger.Errorf("writing cache %s", err)
+	}
+}
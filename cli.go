@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type command struct {
+	Name, Args, Help string
+	Run              func(store *Store, out io.Writer, args []string) error
+}
+
+var commands []*command
+
+// commandInput is where commands read passwords from.
+var commandInput io.Reader = os.Stdin
+
+func init() {
+	commands = []*command{
+		{"repos list", "", "list repositories", reposList},
+		{"repos migrate", "<namespace>", "move repositories kept without a namespace under it", reposMigrate},
+		{"tags list", "<repo>", "list the tags of a repository", tagsList},
+		{"tag set", "<repo> <tag> <image>", "point a tag at an image", tagSet},
+		{"repo rm", "<repo>", "move a repository into the trash", repoRm},
+		{"tag rm", "<repo> <tag>", "move a tag into the trash", tagRm},
+		{"tag history", "<repo> <tag>", "show where a tag has pointed", tagHistory},
+		{"tag rollback", "<repo> <tag> [entry]", "point a tag back at an earlier image", tagRollback},
+		{"image inspect", "<image>", "show the attributes and ancestry of an image", imageInspect},
+		{"image rm", "<image>", "move an untagged image into the trash", imageRm},
+		{"trash list", "", "list deleted tags, repositories and images", trashList},
+		{"trash restore", "<id>", "put a deleted item back", trashRestore},
+		{"revoke token", "<token>", "revoke a session token", revokeToken},
+		{"revoke login", "<login> [time]", "revoke the sessions of a login issued before time, by default now", revokeLogin},
+		{"revoke before", "<time>", "revoke every session issued before time", revokeBefore},
+		{"revocations list", "", "list revoked tokens, logins and times", revocationsList},
+		{"users list", "", "list the accounts of the file user store", usersList},
+		{"user add", "<login> [email]", "create an account, reading its password from stdin", userAdd},
+		{"user passwd", "<login>", "change the password of an account, reading it from stdin", userPasswd},
+		{"du", "", "show the space used by each repository", du},
+		{"gc", "[-dry-run] [-grace=1h] [-trash=168h]", "purge the trash and remove images no tag refers to", gc},
+		{"fsck", "[-repair]", "check the store for broken tags and images", fsck},
+		{"retention", "[-policies=file] [-dry-run] [-grace=1h] [-trash=168h]", "expire tags as the retention policies say", retention},
+	}
+}
+
+// runCommand carries out the maintenance subcommand named by args against
+// the store.
+func runCommand(store *Store, out io.Writer, args []string) error {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.Name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.Name {
+			return cmd.Run(store, out, args[len(words):])
+		}
+	}
+	return errors.New(commandUsage())
+}
+
+func commandUsage() string {
+	usage := "usage: docker-registry [-version] <command>\n\ncommands:\n"
+	for _, cmd := range commands {
+		usage += fmt.Sprintf("  %-40s %s\n", strings.TrimSpace(cmd.Name+" "+cmd.Args), cmd.Help)
+	}
+	return usage
+}
+
+func checkArgs(args []string, n int, usage string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func reposList(store *Store, out io.Writer, args []string) error {
+	names, err := store.Repositories()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(out, name)
+	}
+	return nil
+}
+
+func reposMigrate(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "repos migrate <namespace>"); err != nil {
+		return err
+	}
+
+	moved, err := store.MigrateRepositories(args[0])
+	for _, name := range moved {
+		fmt.Fprintln(out, "moved", name)
+	}
+	return err
+}
+
+func tagsList(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "tags list <repo>"); err != nil {
+		return err
+	}
+
+	tags := store.Repository(args[0]).Tags()
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, tags[name])
+	}
+	return tw.Flush()
+}
+
+func tagSet(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 3, "tag set <repo> <tag> <image>"); err != nil {
+		return err
+	}
+	if err := validateTagName(args[1]); err != nil {
+		return err
+	}
+
+	id, err := NewImageIndex(store.ImagesDir()).Resolve(args[2])
+	if err != nil {
+		return err
+	}
+
+	repo := store.Repository(args[0])
+	if _, err := os.Stat(repo.Dir); err != nil {
+		return fmt.Errorf("repository %s not found", args[0])
+	}
+
+	return repo.SetTag(args[1], []byte(`"`+id+`"`), &TagHistoryEntry{User: os.Getenv("USER")})
+}
+
+func repoRm(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "repo rm <repo>"); err != nil {
+		return err
+	}
+	item, err := store.TrashRepository(args[0], os.Getenv("USER"))
+	return printTrashed(out, item, err)
+}
+
+func tagRm(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 2, "tag rm <repo> <tag>"); err != nil {
+		return err
+	}
+	item, err := store.TrashTag(args[0], args[1], &TagHistoryEntry{User: os.Getenv("USER")}, true)
+	return printTrashed(out, item, err)
+}
+
+func printTrashed(out io.Writer, item *TrashItem, err error) error {
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "trashed as", item.Id)
+	return nil
+}
+
+func tagHistory(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 2, "tag history <repo> <tag>"); err != nil {
+		return err
+	}
+
+	history, err := store.Repository(args[0]).TagHistory(args[1])
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, entry := range history {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", entry.Index, entry.Timestamp.Format(time.RFC3339), entry.Action, entry.ImageId, entry.User, entry.RequestId)
+	}
+	return tw.Flush()
+}
+
+func tagRollback(store *Store, out io.Writer, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("usage: tag rollback <repo> <tag> [entry]")
+	}
+
+	index := -1
+	if len(args) == 3 {
+		var err error
+		if index, err = strconv.Atoi(args[2]); err != nil {
+			return fmt.Errorf("entry must be a history index")
+		}
+	}
+
+	target, err := store.RollbackTarget(args[0], args[1], index)
+	if err != nil {
+		return err
+	}
+
+	entry := &TagHistoryEntry{User: os.Getenv("USER")}
+	if err := store.RollbackTag(args[0], args[1], target, entry, true); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s now points at %s\n", args[1], entry.ImageId)
+	return nil
+}
+
+func imageInspect(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "image inspect <image>"); err != nil {
+		return err
+	}
+
+	id, err := NewImageIndex(store.ImagesDir()).Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	inspection, err := store.Image(id).Inspect()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(inspection, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func imageRm(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "image rm <image>"); err != nil {
+		return err
+	}
+
+	id, err := NewImageIndex(store.ImagesDir()).Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	item, err := store.TrashImage(id, os.Getenv("USER"))
+	return printTrashed(out, item, err)
+}
+
+func trashList(store *Store, out io.Writer, args []string) error {
+	items, err := store.Trash()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, item := range items {
+		name := item.Repository
+		switch item.Kind {
+		case TrashTag:
+			name += ":" + item.Tag
+		case TrashImage:
+			name = item.ImageId
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", item.Id, item.DeletedAt.Format(time.RFC3339), item.Kind, name, item.DeletedBy)
+	}
+	return tw.Flush()
+}
+
+func trashRestore(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "trash restore <id>"); err != nil {
+		return err
+	}
+	_, err := store.Restore(args[0], &TagHistoryEntry{User: os.Getenv("USER")})
+	return err
+}
+
+func revokeToken(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "revoke token <token>"); err != nil {
+		return err
+	}
+	return store.Revocations().RevokeToken(args[0])
+}
+
+func revokeLogin(store *Store, out io.Writer, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: revoke login <login> [time]")
+	}
+
+	before := time.Now()
+	if len(args) == 2 {
+		var err error
+		if before, err = time.Parse(time.RFC3339, args[1]); err != nil {
+			return err
+		}
+	}
+	return store.Revocations().RevokeLogin(args[0], before)
+}
+
+func revokeBefore(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "revoke before <time>"); err != nil {
+		return err
+	}
+	before, err := time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return err
+	}
+	return store.Revocations().RevokeBefore(before)
+}
+
+func revocationsList(store *Store, out io.Writer, args []string) error {
+	list, err := store.Revocations().List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	if !list.Before.IsZero() {
+		fmt.Fprintf(tw, "all\tissued before %s\n", list.Before.Format(time.RFC3339))
+	}
+	for _, login := range sortedKeys(list.Logins) {
+		fmt.Fprintf(tw, "login %s\tissued before %s\n", login, list.Logins[login].Format(time.RFC3339))
+	}
+	for _, hash := range sortedKeys(list.Tokens) {
+		fmt.Fprintf(tw, "token %s\trevoked %s\n", hash, list.Tokens[hash].Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func usersList(store *Store, out io.Writer, args []string) error {
+	logins, err := store.Users().Logins()
+	if err != nil {
+		return err
+	}
+	for _, login := range logins {
+		fmt.Fprintln(out, login)
+	}
+	return nil
+}
+
+func userAdd(store *Store, out io.Writer, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: user add <login> [email]")
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	email := ""
+	if len(args) == 2 {
+		email = args[1]
+	}
+	return store.Users().Create(args[0], password, email)
+}
+
+func userPasswd(store *Store, out io.Writer, args []string) error {
+	if err := checkArgs(args, 1, "user passwd <login>"); err != nil {
+		return err
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Users().SetPassword(args[0], password); err != nil {
+		return err
+	}
+	return store.Revocations().RevokeLogin(args[0], time.Now())
+}
+
+// readPassword reads the first line of commandInput.
+func readPassword() (string, error) {
+	line, err := bufio.NewReader(commandInput).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func sortedKeys(m map[string]time.Time) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func du(store *Store, out io.Writer, args []string) error {
+	usage := NewQuotas(store.Dir, "", nil).Usage()
+
+	names, err := store.Repositories()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	for _, name := range names {
+		var used int64
+		if u, ok := usage[name]; ok {
+			used = u.Used
+		}
+		fmt.Fprintf(tw, "%d\t  %s\n", used, name)
+	}
+	fmt.Fprintf(tw, "%d\t  %s\n", dirSize(store.ImagesDir()), "total images")
+	return tw.Flush()
+}
+
+func gc(store *Store, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	grace := flags.Duration("grace", time.Hour, "keep images changed more recently than this")
+	trash := flags.Duration("trash", 168*time.Hour, "keep deleted items in the trash this long")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := store.GC(*grace, *trash, *dryRun)
+	printGCReport(out, report, *dryRun)
+	return err
+}
+
+func printGCReport(out io.Writer, report *GCReport, dryRun bool) {
+	purge, remove, summary := "purged", "removed", "freed"
+	if dryRun {
+		purge, remove, summary = "would purge", "would remove", "would free"
+	}
+	for _, item := range report.Purged {
+		fmt.Fprintln(out, purge, item.Id)
+	}
+	for _, id := range report.Removed {
+		fmt.Fprintln(out, remove, id)
+	}
+	fmt.Fprintf(out, "%s %d bytes\n", summary, report.Freed)
+}
+
+func fsck(store *Store, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "move broken objects into quarantine")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := store.Fsck(*repair)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, problem := range report.Problems {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", problem.Kind, problem.Path, problem.Detail)
+	}
+	tw.Flush()
+
+	for _, path := range report.Quarantined {
+		fmt.Fprintln(out, "quarantined", path)
+	}
+
+	if len(report.Problems) > 0 && !*repair {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+	return nil
+}
+
+func retention(store *Store, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("retention", flag.ContinueOnError)
+	file := flags.String("policies", os.Getenv("REGISTRY_RETENTION"), "json file holding the retention policies")
+	dryRun := flags.Bool("dry-run", false, "only report what would be expired and removed")
+	grace := flags.Duration("grace", time.Hour, "keep images changed more recently than this")
+	trash := flags.Duration("trash", 168*time.Hour, "keep deleted items in the trash this long")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("usage: retention -policies=file")
+	}
+
+	policies, err := LoadRetentionPolicies(*file)
+	if err != nil {
+		return err
+	}
+
+	report, err := store.ApplyRetention(policies, *grace, *trash, *dryRun)
+	if report == nil {
+		return err
+	}
+
+	expire := "expired"
+	if *dryRun {
+		expire = "would expire"
+	}
+	for _, tag := range report.Expired {
+		fmt.Fprintf(out, "%s %s:%s\n", expire, tag.Repository, tag.Tag)
+	}
+	if report.GCReport != nil {
+		printGCReport(out, report.GCReport, *dryRun)
+	}
+	return err
+}
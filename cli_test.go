@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// copyFixtures fills a fresh data dir with the fixture index so tests can
+// modify it.
+func copyFixtures() string {
+	dataDir := resetTmpDataDir()
+	root, _ := filepath.Abs("fixtures/index")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		target := filepath.Join(dataDir, strings.TrimPrefix(path, root))
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		in, _ := os.Open(path)
+		defer in.Close()
+		out, _ := os.Create(target)
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+	return dataDir
+}
+
+func (t *testSuite) TestCommandReposAndTags() {
+	store := &Store{copyFixtures()}
+	out := &bytes.Buffer{}
+
+	t.Nil(runCommand(store, out, []string{"repos", "list"}))
+	t.Equal("dynport/redis\n", out.String())
+
+	out.Reset()
+	t.Nil(runCommand(store, out, []string{"tag", "set", "dynport/redis", "stable", "0e03"}))
+	t.Nil(runCommand(store, out, []string{"tags", "list", "dynport/redis"}))
+	t.Equal("latest  e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5\n"+
+		"stable  0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8\n", out.String())
+
+	t.Nil(runCommand(store, out, []string{"tag", "rm", "dynport/redis", "stable"}))
+	t.Equal(1, len(store.Repository("dynport/redis").Tags()))
+
+	t.True(runCommand(store, out, []string{"tag", "set", "dynport/redis", "stable", "ffff"}) != nil)
+	t.True(runCommand(store, out, []string{"bogus"}) != nil)
+}
+
+func (t *testSuite) TestCommandImageInspect() {
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(&Store{"fixtures/index"}, out, []string{"image", "inspect", "e0ac"}))
+	t.True(strings.Contains(out.String(), `"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c"`))
+	t.True(strings.Contains(out.String(), `"stored_size": 93`))
+	t.True(strings.Contains(out.String(), `"total_stored_size": 279`))
+}
+
+func (t *testSuite) TestCommandGC() {
+	store := &Store{copyFixtures()}
+	out := &bytes.Buffer{}
+
+	// drop the tag so the whole chain becomes garbage, except what's recent
+	os.Remove(store.Repository("dynport/redis").Dir + "/tags/latest")
+	old := time.Now().Add(-2 * time.Hour)
+	for _, id := range []string{"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8"} {
+		image := store.Image(id)
+		os.Chtimes(image.Dir+"/json", old, old)
+		os.Chtimes(image.Dir+"/layer", old, old)
+		os.Chtimes(image.Dir, old, old)
+	}
+
+	t.Nil(runCommand(store, out, []string{"gc", "-dry-run"}))
+	t.True(strings.Contains(out.String(), "would free"))
+	ids, _ := store.ImageIds()
+	t.Equal(3, len(ids))
+
+	t.Nil(runCommand(store, out, []string{"gc"}))
+	ids, _ = store.ImageIds()
+	t.Equal([]string{"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c"}, ids)
+}
@@ -4,6 +4,15 @@ import "github.com/kelseyhightower/envconfig"
 
 type Configuration struct {
 	Listen, Data, Namespace, Redis, Secret, Pass string
+	RateLimits, Quotas, Admins                   string
+	ScrubInterval, ScrubRate                     string
+	Retention, RetentionInterval, TrashRetention string
+	PushTimeout                                  string
+	MaxJsonSize, MaxTagSize, MaxLayerSize        string
+	HeaderTimeout, IdleTimeout, ChunkTimeout     string
+	TmpMaxAge, TmpSweepInterval                  string
+	SessionStore, SessionTTL, MaxSessions        string
+	UserStore, Registration                      string
 	Debug                                        bool
 }
 
@@ -36,6 +45,70 @@ func LoadConfiguration() (*Configuration, error) {
 		conf.Data = "/var/lib/docker-registry/docker_index"
 	}
 
+	if conf.ScrubRate == "" {
+		conf.ScrubRate = "10M"
+	}
+
+	if conf.TrashRetention == "" {
+		conf.TrashRetention = "168h"
+	}
+
+	if conf.PushTimeout == "" {
+		conf.PushTimeout = "24h"
+	}
+
+	if conf.MaxJsonSize == "" {
+		conf.MaxJsonSize = "1M"
+	}
+
+	if conf.MaxTagSize == "" {
+		conf.MaxTagSize = "1K"
+	}
+
+	if conf.MaxLayerSize == "" {
+		conf.MaxLayerSize = "10G"
+	}
+
+	if conf.HeaderTimeout == "" {
+		conf.HeaderTimeout = "30s"
+	}
+
+	if conf.IdleTimeout == "" {
+		conf.IdleTimeout = "120s"
+	}
+
+	if conf.ChunkTimeout == "" {
+		conf.ChunkTimeout = "60s"
+	}
+
+	if conf.TmpMaxAge == "" {
+		conf.TmpMaxAge = "1h"
+	}
+
+	if conf.TmpSweepInterval == "" {
+		conf.TmpSweepInterval = "1h"
+	}
+
+	if conf.SessionStore == "" {
+		conf.SessionStore = "memory"
+	}
+
+	if conf.SessionTTL == "" {
+		conf.SessionTTL = "24h"
+	}
+
+	if conf.MaxSessions == "" {
+		conf.MaxSessions = "10"
+	}
+
+	if conf.UserStore == "" {
+		conf.UserStore = "single"
+	}
+
+	if conf.Registration == "" {
+		conf.Registration = "closed"
+	}
+
 	if conf.Pass == "" {
 		conf.Pass = "test1234asdfg"
 	}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+const (
+	CodeBadRequest      = "BAD_REQUEST"
+	CodeUnauthorized    = "UNAUTHORIZED"
+	CodeForbidden       = "FORBIDDEN"
+	CodeNotFound        = "NOT_FOUND"
+	CodeConflict        = "CONFLICT"
+	CodeAmbiguousImage  = "AMBIGUOUS_IMAGE"
+	CodeTagProtected    = "TAG_PROTECTED"
+	CodeQuotaExceeded   = "QUOTA_EXCEEDED"
+	CodePushIncomplete  = "PUSH_INCOMPLETE"
+	CodeLayerCorrupt    = "LAYER_CORRUPT"
+	CodeTooManyRequests = "TOO_MANY_REQUESTS"
+	CodeTooLarge        = "TOO_LARGE"
+	CodeTimeout         = "REQUEST_TIMEOUT"
+	CodeStorageFull     = "STORAGE_FULL"
+	CodeInternal        = "INTERNAL_ERROR"
+)
+
+// ApiError is written as the body of every error response, Code is stable
+// for clients to act on while Message is meant for people.
+type ApiError struct {
+	Status    int         `json:"-"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Detail    interface{} `json:"detail,omitempty"`
+	RequestId string      `json:"request_id,omitempty"`
+}
+
+func NewApiError(status int, code, format string, args ...interface{}) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+func (e *ApiError) WithDetail(detail interface{}) *ApiError {
+	e.Detail = detail
+	return e
+}
+
+func badRequest(format string, args ...interface{}) *ApiError {
+	return NewApiError(http.StatusBadRequest, CodeBadRequest, format, args...)
+}
+
+func notFound(format string, args ...interface{}) *ApiError {
+	return NewApiError(http.StatusNotFound, CodeNotFound, format, args...)
+}
+
+func conflict(format string, args ...interface{}) *ApiError {
+	return NewApiError(http.StatusConflict, CodeConflict, format, args...)
+}
+
+func tooLargeError(limit int64) *ApiError {
+	return NewApiError(http.StatusRequestEntityTooLarge, CodeTooLarge, "request body exceeds the limit of %d bytes", limit).WithDetail(map[string]int64{
+		"limit": limit,
+	})
+}
+
+// bodyError classifies a failure reading the request body, which is down to
+// the client unless the body was too large or stopped arriving.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	var upload *uploadError
+	if errors.As(err, &tooLarge) || errors.As(err, &upload) {
+		return err
+	}
+	return badRequest("reading request body: %s", err)
+}
+
+// asApiError gives errors from the store the status and code clients see,
+// anything unexpected is an internal error.
+func asApiError(err error) *ApiError {
+	switch e := err.(type) {
+	case *ApiError:
+		return e
+	case *ProtectionError:
+		return NewApiError(e.Status, CodeTagProtected, "%s", e.Error()).WithDetail(map[string]string{
+			"tag": e.Tag, "mode": e.Mode, "rule": e.Rule, "action": e.Action,
+		})
+	case *QuotaExceededError:
+		return NewApiError(http.StatusForbidden, CodeQuotaExceeded, "%s", e.Error()).WithDetail(map[string]interface{}{
+			"scope": e.Scope, "used": e.Used, "limit": e.Limit,
+		})
+	case *AmbiguousImageError:
+		return NewApiError(http.StatusConflict, CodeAmbiguousImage, "%s", e.Error()).WithDetail(map[string]interface{}{
+			"candidates": e.Candidates,
+		})
+	case *IncompletePushError:
+		return NewApiError(http.StatusBadRequest, CodePushIncomplete, "%s", e.Error()).WithDetail(map[string]interface{}{
+			"missing": e.Missing,
+		})
+	case *queryError:
+		return badRequest("%s", e.Error())
+	case *rollbackError:
+		return conflict("%s", e.Error())
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return tooLargeError(tooLarge.Limit)
+	}
+
+	var upload *uploadError
+	if errors.As(err, &upload) {
+		if upload.Timeout() {
+			return NewApiError(http.StatusRequestTimeout, CodeTimeout, "%s", upload.Error())
+		}
+		return badRequest("%s", upload.Error())
+	}
+
+	switch {
+	case err == ErrImageNotFound || err == ErrTrashNotFound || err == ErrTokenNotFound || err == ErrUserNotFound || os.IsNotExist(err):
+		return notFound("%s", err.Error())
+	case err == ErrObjectExists || err == ErrImageReferenced || err == ErrRestoreConflict || err == ErrNoEarlierTag:
+		return conflict("%s", err.Error())
+	case errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT):
+		return NewApiError(http.StatusInsufficientStorage, CodeStorageFull, "the registry is out of storage space")
+	}
+	return NewApiError(http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// writeError answers the request with the json envelope for err, logging
+// the errors which are the registry's fault rather than the client's.
+func writeError(w http.ResponseWriter, err error) {
+	e := asApiError(err)
+	e.RequestId = w.Header().Get("X-Request-ID")
+
+	if e.Status >= 500 {
+		logger.Errorf("%s %s", e.RequestId, err)
+	} else {
+		logger.Infof("%s %s", e.RequestId, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+)
+
+func (t *testSuite) TestErrorEnvelope() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path, body string) (*http.Response, *ApiError) {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		rsp, _ := http.DefaultClient.Do(req)
+		apiErr := &ApiError{}
+		json.NewDecoder(rsp.Body).Decode(apiErr)
+		rsp.Body.Close()
+		return rsp, apiErr
+	}
+
+	rsp, apiErr := do("GET", "/v1/images/ffff/json", "")
+	t.Equal(404, rsp.StatusCode)
+	t.Equal("application/json", rsp.Header.Get("Content-Type"))
+	t.Equal(CodeNotFound, apiErr.Code)
+	t.Equal(rsp.Header.Get("X-Request-ID"), apiErr.RequestId)
+
+	rsp, apiErr = do("GET", "/v1/repositories/dynport/redis/tags/_detail?sort=size", "")
+	t.Equal(400, rsp.StatusCode)
+	t.Equal(CodeBadRequest, apiErr.Code)
+
+	rsp, apiErr = do("GET", "/v1/repositories/dynport/missing/tags", "")
+	t.Equal(404, rsp.StatusCode)
+
+	rsp, apiErr = do("GET", "/v1/_admin/quotas", "")
+	t.Equal(401, rsp.StatusCode)
+	t.Equal(CodeUnauthorized, apiErr.Code)
+
+	// a failed write is no longer answered with a 200
+	ioutil.WriteFile(h.DataDir+"/images/abc", []byte("in the way"), 0644)
+	rsp, apiErr = do("PUT", "/v1/images/abc/json", `{"id":"abc"}`)
+	t.Equal(500, rsp.StatusCode)
+	t.Equal(CodeInternal, apiErr.Code)
+
+	rsp, apiErr = do("PUT", "/v1/images/e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5/json", `{"id":"other"}`)
+	t.Equal(409, rsp.StatusCode)
+	t.Equal(CodeConflict, apiErr.Code)
+}
+
+func (t *testSuite) TestApiErrorStatus() {
+	t.Equal(507, asApiError(&os.PathError{Op: "write", Path: "layer", Err: syscall.ENOSPC}).Status)
+	t.Equal(404, asApiError(ErrImageNotFound).Status)
+	t.Equal(403, asApiError(&QuotaExceededError{"dynport", 10, 5}).Status)
+	t.Equal(409, asApiError(&ProtectionError{Status: 409}).Status)
+	t.Equal(500, asApiError(os.ErrPermission).Status)
+}
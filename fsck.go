@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ProblemDanglingTag      = "dangling-tag"
+	ProblemMissingJson      = "missing-json"
+	ProblemMalformedJson    = "malformed-json"
+	ProblemMissingLayer     = "missing-layer"
+	ProblemMissingParent    = "missing-parent"
+	ProblemBrokenAncestry   = "broken-ancestry"
+	ProblemChecksumMismatch = "checksum-mismatch"
+	ProblemOrphanedTmp      = "orphaned-tmp"
+)
+
+type Problem struct {
+	Kind, Path, Detail string
+}
+
+type FsckReport struct {
+	Problems    []*Problem
+	Quarantined []string
+}
+
+func (r *FsckReport) add(kind, path, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &Problem{kind, path, fmt.Sprintf(format, args...)})
+}
+
+// Fsck checks every repository and image in the store is complete and
+// consistent. With repair set broken images, tags pointing at them and
+// leftover temporary files are moved under quarantine/ rather than deleted.
+func (s *Store) Fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{}
+
+	ids, err := s.ImageIds()
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool)
+	for _, id := range ids {
+		exists[id] = true
+	}
+
+	// objects to quarantine, by path
+	broken := make(map[string]bool)
+	parents := make(map[string]string)
+
+	for _, id := range ids {
+		image := s.Image(id)
+		if atts, ok := s.checkImage(report, image); ok {
+			parents[id] = atts.Parent
+		} else {
+			broken[image.Dir] = true
+		}
+	}
+
+	for _, id := range ids {
+		image := s.Image(id)
+		if parent := parents[id]; parent != "" && !exists[parent] {
+			report.add(ProblemMissingParent, image.Dir, "parent %s does not exist", parent)
+			broken[image.Dir] = true
+		}
+	}
+
+	// an image is only usable when its whole ancestry is
+	for _, id := range ids {
+		seen := map[string]bool{id: true}
+		for ancestor := parents[id]; ancestor != ""; ancestor = parents[ancestor] {
+			if seen[ancestor] {
+				report.add(ProblemBrokenAncestry, s.Image(id).Dir, "ancestry loops at %s", ancestor)
+				broken[s.Image(id).Dir] = true
+				break
+			}
+			seen[ancestor] = true
+
+			if broken[s.Image(ancestor).Dir] && !broken[s.Image(id).Dir] {
+				report.add(ProblemBrokenAncestry, s.Image(id).Dir, "ancestor %s is broken", ancestor)
+				broken[s.Image(id).Dir] = true
+				break
+			}
+		}
+	}
+
+	names, err := s.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		repo := s.Repository(name)
+
+		if data, err := repo.Images(); err == nil && !json.Valid(data) {
+			report.add(ProblemMalformedJson, repo.ImagesPath(), "images list is not valid json")
+			broken[repo.ImagesPath()] = true
+		}
+
+		for tag, id := range repo.Tags() {
+			path := repo.Dir + "/tags/" + tag
+			switch {
+			case !exists[id]:
+				report.add(ProblemDanglingTag, path, "image %s does not exist", id)
+				broken[path] = true
+			case broken[s.Image(id).Dir]:
+				report.add(ProblemDanglingTag, path, "image %s is broken", id)
+				broken[path] = true
+			}
+		}
+	}
+
+	s.walkTempFiles(func(path string, info os.FileInfo) {
+		report.add(ProblemOrphanedTmp, path, "%d bytes left by an unfinished write", info.Size())
+		broken[path] = true
+	})
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Path < report.Problems[j].Path
+	})
+
+	if repair {
+		return report, s.quarantine(report, broken)
+	}
+	return report, nil
+}
+
+func (s *Store) checkImage(report *FsckReport, image *Image) (*ImageHeader, bool) {
+	ok := true
+
+	atts, err := image.Header()
+	switch {
+	case os.IsNotExist(err):
+		report.add(ProblemMissingJson, image.Dir, "json does not exist")
+		ok = false
+	case err != nil:
+		report.add(ProblemMalformedJson, image.Dir+"/json", "%s", err)
+		ok = false
+	}
+
+	if _, err := os.Stat(image.LayerPath()); err != nil {
+		report.add(ProblemMissingLayer, image.Dir, "layer does not exist")
+		return atts, false
+	}
+
+	// only layers with a recorded checksum can be verified
+	if data, err := ioutil.ReadFile(image.ChecksumPath()); err == nil {
+		recorded := strings.TrimSpace(string(data))
+		if actual, err := image.LayerChecksum(); err != nil || actual != recorded {
+			report.add(ProblemChecksumMismatch, image.LayerPath(), "recorded %s but layer hashes to %s", recorded, actual)
+			ok = false
+		}
+	}
+
+	return atts, ok
+}
+
+func (s *Store) quarantine(report *FsckReport, broken map[string]bool) error {
+	dir := filepath.Join(s.Dir, "quarantine", time.Now().UTC().Format("20060102T150405Z"))
+
+	paths := make([]string, 0, len(broken))
+	for path := range broken {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		// already moved along with the image it belongs to
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		report.Quarantined = append(report.Quarantined, rel)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+)
+
+func (t *testSuite) TestFsckClean() {
+	report, err := (&Store{"fixtures/index"}).Fsck(false)
+	t.Nil(err)
+	t.Equal(0, len(report.Problems))
+}
+
+func (t *testSuite) TestFsckRepair() {
+	store := &Store{copyFixtures()}
+
+	// break the middle of the chain, which takes the tagged image with it
+	os.Remove(store.Image("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8").LayerPath())
+	ioutil.WriteFile(store.Image("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c").ChecksumPath(), []byte("sha256:0000"), 0644)
+	ioutil.WriteFile(store.ImagesDir()+"/8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c/layer.tmp", []byte("partial"), 0644)
+
+	report, err := store.Fsck(false)
+	t.Nil(err)
+
+	kinds := map[string]int{}
+	for _, problem := range report.Problems {
+		kinds[problem.Kind]++
+	}
+	t.Equal(1, kinds[ProblemMissingLayer])
+	t.Equal(1, kinds[ProblemChecksumMismatch])
+	t.Equal(1, kinds[ProblemOrphanedTmp])
+	t.Equal(1, kinds[ProblemBrokenAncestry])
+	t.Equal(1, kinds[ProblemDanglingTag])
+
+	out := &bytes.Buffer{}
+	t.True(runCommand(store, out, []string{"fsck"}) != nil)
+	t.Nil(runCommand(store, out, []string{"fsck", "-repair"}))
+
+	ids, _ := store.ImageIds()
+	t.Equal(0, len(ids))
+	t.Equal(0, len(store.Repository("dynport/redis").Tags()))
+
+	report, _ = store.Fsck(false)
+	t.Equal(0, len(report.Problems))
+}
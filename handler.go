@@ -4,17 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wolfeidau/docker-registry/uuid"
 )
 
 type HttpRouteHandler func(http.ResponseWriter, *http.Request, [][]string)
-type HttpAuthHandler func(http.ResponseWriter, *http.Request) bool
+type HttpAuthHandler func(http.ResponseWriter, *http.Request, [][]string) bool
 
 type Mapping struct {
 	Method        string
@@ -23,12 +25,46 @@ type Mapping struct {
 	Handler       HttpRouteHandler
 }
 
+// UploadLimits bounds the size of request bodies in bytes, zero leaves them
+// unbounded.
+type UploadLimits struct {
+	Json, Tag, Layer int64
+}
+
 type Handler struct {
 	DataDir, Namespace string
 	Auth               UserAuth
+	Admins             []string
+	Images             *ImageIndex
+	Pushes             *Pushes
+	Quotas             *Quotas
+	Retention          []*RetentionPolicy
+	TrashRetention     time.Duration
+	UploadLimits       UploadLimits
+	ChunkTimeout       time.Duration
+	Cache              SessionStore
+	Revocations        *Revocations
+	Tokens             *AccessTokens
+	Users              UserStore
+	OpenRegistration   bool
 	Mappings           []*Mapping
 }
 
+// limitBody rejects a request whose Content-Length is over max before any of
+// the body is read, so a client waiting on 100-continue never sends it, and
+// stops reading a body without one once it passes max.
+func (h *Handler) limitBody(w http.ResponseWriter, r *http.Request, max int64) bool {
+	if max <= 0 {
+		return true
+	}
+	if r.ContentLength > max {
+		writeError(w, tooLargeError(max))
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	return true
+}
+
 func (h *Handler) WriteJsonHeader(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json")
 }
@@ -37,6 +73,50 @@ func (h *Handler) WriteEndpointsHeader(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("X-Docker-Endpoints", r.Host)
 }
 
+// resolveImage maps the id prefix from the url onto a single image, writing
+// a 404 or a 409 listing the candidates when that isn't possible.
+func (h *Handler) resolveImage(w http.ResponseWriter, r *http.Request, idPrefix string) (*Image, bool) {
+	id, err := h.Images.Resolve(idPrefix)
+	if err != nil {
+		writeError(w, err)
+		return nil, false
+	}
+	return &Image{h.DataDir + "/images/" + id}, true
+}
+
+func (h *Handler) store() *Store {
+	return &Store{h.DataDir}
+}
+
+// requestSession returns the session making the request, if any.
+func (h *Handler) requestSession(w http.ResponseWriter, r *http.Request) *Session {
+	if finder, ok := h.Auth.(SessionFinder); ok {
+		if session, ok := finder.FindSession(requestToken(w, r)); ok {
+			return session
+		}
+	}
+	return nil
+}
+
+// requestLogin returns the login of the session making the request, if any.
+func (h *Handler) requestLogin(w http.ResponseWriter, r *http.Request) string {
+	if session := h.requestSession(w, r); session != nil {
+		return session.Login
+	}
+	return ""
+}
+
+// requestIsAdmin is true when the request has a session belonging to an
+// admin, access tokens never act as admins.
+func (h *Handler) requestIsAdmin(w http.ResponseWriter, r *http.Request) bool {
+	session := h.requestSession(w, r)
+	return session != nil && session.TokenId == "" && h.isAdmin(session.Login)
+}
+
+func (h *Handler) repository(name string) *Repository {
+	return &Repository{h.DataDir + "/repositories/" + h.Namespace + "/" + name}
+}
+
 func (h *Handler) GetPing(w http.ResponseWriter, r *http.Request, p [][]string) {
 	logger.Infof("GetPing %s", p)
 
@@ -46,182 +126,858 @@ func (h *Handler) GetPing(w http.ResponseWriter, r *http.Request, p [][]string)
 	fmt.Fprint(w, "pong")
 }
 
+// GetUsers is how docker login checks credentials, any authenticated
+// session will do.
 func (h *Handler) GetUsers(w http.ResponseWriter, r *http.Request, p [][]string) {
+	if h.requestSession(w, r) == nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="docker-registry"`)
+		writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "authentication required"))
+		return
+	}
 	w.WriteHeader(200)
 	fmt.Fprint(w, "OK")
 }
 
+// PostUsers registers an account, which docker login tries before checking
+// the credentials with GetUsers. Docker only goes on to that check when the
+// user already exists, answered with exactly the body it looks for, or when
+// refused with a 401, so a closed registration is a 401. Admins can create
+// accounts while registration is closed.
 func (h *Handler) PostUsers(w http.ResponseWriter, r *http.Request, p [][]string) {
-	logger.Printf("p %v", p)
-	w.WriteHeader(201)
-	fmt.Fprint(w, "OK")
+	admin := false
+	if _, ok := r.Header["Authorization"]; ok && h.Auth != nil {
+		session, err := h.Auth.CheckAuth(r)
+		admin = err == nil && session.TokenId == "" && h.isAdmin(session.Login)
+	}
+
+	users, writable := h.Users.(WritableUserStore)
+	if !writable || !(h.OpenRegistration || admin) {
+		writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "registration is closed"))
+		return
+	}
+
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	user := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+
+	// logging in with an access token or as a robot account isn't a
+	// registration, docker has to check the credentials instead
+	exists := users.Exists(user.Username) || isAccessToken(user.Password) || strings.HasPrefix(user.Username, robotPrefix)
+	if !exists {
+		if err := validateLogin(user.Username); err != nil {
+			writeError(w, badRequest("%s", err))
+			return
+		}
+		if err := validatePassword(user.Password); err != nil {
+			writeError(w, badRequest("%s", err))
+			return
+		}
+
+		err := users.Create(user.Username, user.Password, user.Email)
+		if err != nil && err != ErrUserExists {
+			writeError(w, err)
+			return
+		}
+		exists = err == ErrUserExists
+	}
+
+	h.WriteJsonHeader(w)
+	if exists {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `"Username or email already exists"`)
+		return
+	}
+
+	logger.Infof("registered user %s", user.Username)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, `"User Created"`)
+}
+
+// PutUser changes the password of an account, its owner or an admin may,
+// and ends the sessions made with the old one.
+func (h *Handler) PutUser(w http.ResponseWriter, r *http.Request, p [][]string) {
+	login := p[0][2]
+	if h.requestLogin(w, r) != login && !h.requestIsAdmin(w, r) {
+		writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "only %s or an admin can change the account", login))
+		return
+	}
+
+	users, writable := h.Users.(WritableUserStore)
+	if !writable {
+		writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "accounts can't be changed"))
+		return
+	}
+
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	user := struct {
+		Password string `json:"password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	if err := validatePassword(user.Password); err != nil {
+		writeError(w, badRequest("%s", err))
+		return
+	}
+
+	if err := users.SetPassword(login, user.Password); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.Revocations.RevokeLogin(login, time.Now()); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) GetRepositoryImages(w http.ResponseWriter, r *http.Request, p [][]string) {
 
-	repo := &Repository{h.DataDir + "/repositories/" + p[0][2]}
+	repo := h.repository(p[0][2])
 
-	if images, err := repo.Images(); err == nil {
-		h.WriteJsonHeader(w)
-		h.WriteEndpointsHeader(w, r)
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, string(images))
-	} else {
-		logger.Error(err.Error())
-		w.WriteHeader(http.StatusNotFound)
+	images, err := repo.Images()
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
+	h.WriteJsonHeader(w)
+	h.WriteEndpointsHeader(w, r)
+	w.WriteHeader(http.StatusOK)
+	w.Write(images)
 }
 
 func (h *Handler) GetImageAncestry(w http.ResponseWriter, r *http.Request, p [][]string) {
-	idPrefix := p[0][2]
-
-	globPath := h.DataDir + "/images/" + idPrefix + "*"
-	logger.Printf("GetImageAncestry %s", globPath)
-
-	if paths, err := filepath.Glob(globPath); err == nil {
-		if len(paths) > 0 {
-			image := &Image{paths[0]}
-			if out, err := json.Marshal(image.Ancestry()); err == nil {
-				h.WriteJsonHeader(w)
-				w.WriteHeader(http.StatusOK)
-				fmt.Fprintf(w, string(out))
-				return
-			}
-		}
+	logger.Printf("GetImageAncestry %s", p[0][2])
+
+	image, ok := h.resolveImage(w, r, p[0][2])
+	if !ok {
+		return
+	}
+
+	ancestry, err := h.cachedAncestry(image)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	http.NotFound(w, r)
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ancestry)
 }
 
 func (h *Handler) GetImageLayer(w http.ResponseWriter, r *http.Request, p [][]string) {
-	idPrefix := p[0][2]
-
-	globPath := h.DataDir + "/images/" + idPrefix + "*"
-	logger.Printf("GetImageLayer %s", globPath)
-
-	if paths, err := filepath.Glob(globPath); err == nil {
-		image := &Image{paths[0]}
-		file, err := os.Open(image.LayerPath())
-		if err == nil {
-			w.Header().Add("Content-Type", "application/x-xz")
-			w.WriteHeader(http.StatusOK)
-			io.Copy(w, file)
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-		}
+	logger.Printf("GetImageLayer %s", p[0][2])
+
+	image, ok := h.resolveImage(w, r, p[0][2])
+	if !ok {
+		return
+	}
+
+	if image.Corrupt() {
+		logger.Errorf("refusing to serve corrupt layer of %s", image.Id())
+		writeError(w, NewApiError(http.StatusInternalServerError, CodeLayerCorrupt, "layer of %s failed checksum verification", image.Id()))
+		return
+	}
+
+	checksum, err := image.Checksum()
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+
+	file, err := os.Open(image.LayerPath())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-xz")
+	w.Header().Set("ETag", `"`+checksum+`"`)
+
+	// a prefix may later become ambiguous, only a full id names the layer forever
+	if image.Id() == p[0][2] {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	// handles Range, If-None-Match and If-Modified-Since for us
+	http.ServeContent(w, r, "", stat.ModTime(), file)
 }
 
 func (h *Handler) GetImageJson(w http.ResponseWriter, r *http.Request, p [][]string) {
-	idPrefix := p[0][2]
-
-	globPath := h.DataDir + "/images/" + idPrefix + "*"
-	logger.Printf("GetImageJson %s", globPath)
-
-	if paths, err := filepath.Glob(globPath); err == nil {
-		if len(paths) > 0 {
-			image := &Image{paths[0]}
-			file, err := os.Open(image.Dir + "/json")
-			if err == nil {
-				if file, err := os.Open(image.LayerPath()); err == nil {
-					if stat, err := file.Stat(); err == nil {
-						w.Header().Add("X-Docker-Size", fmt.Sprintf("%d", stat.Size()))
-					}
-				}
-				io.Copy(w, file)
-				return
-			}
-		}
+	logger.Printf("GetImageJson %s", p[0][2])
+
+	image, ok := h.resolveImage(w, r, p[0][2])
+	if !ok {
+		return
+	}
+
+	file, err := os.Open(image.Dir + "/json")
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	defer file.Close()
 
-	w.WriteHeader(http.StatusNotFound)
+	if stat, err := os.Stat(image.LayerPath()); err == nil {
+		w.Header().Add("X-Docker-Size", fmt.Sprintf("%d", stat.Size()))
+	}
+	io.Copy(w, file)
+}
+
+func (h *Handler) GetImageInspect(w http.ResponseWriter, r *http.Request, p [][]string) {
+	image, ok := h.resolveImage(w, r, p[0][2])
+	if !ok {
+		return
+	}
+
+	inspection, err := image.Inspect()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(inspection)
 }
 
 func (h *Handler) GetRepositoryTags(w http.ResponseWriter, r *http.Request, p [][]string) {
 
-	repo := &Repository{h.DataDir + "/repositories/" + p[0][2]}
-	tagsJson, err := json.Marshal(repo.Tags())
+	repo := h.repository(p[0][2])
+	if _, err := os.Stat(repo.Dir); err != nil {
+		writeError(w, notFound("repository %s not found", p[0][2]))
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	h.WriteEndpointsHeader(w, r)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.cachedTags(repo))
+}
+
+// GetRepositoryTagDetails lists tags with the metadata of their images,
+// filtered, sorted and paged according to the query string.
+func (h *Handler) GetRepositoryTagDetails(w http.ResponseWriter, r *http.Request, p [][]string) {
+	repoName := p[0][2]
 
+	query, err := ParseTagQuery(r.URL.Query())
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, err)
+		return
+	}
+
+	if _, err := os.Stat(h.repository(repoName).Dir); err != nil {
+		writeError(w, notFound("repository %s not found", repoName))
 		return
 	}
 
+	page, total, more := query.Apply(h.store().TagDetails(h.Namespace + "/" + repoName))
+
+	if more {
+		next := r.URL.Query()
+		next.Set("last", page[len(page)-1].Name)
+		w.Header().Add("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+
 	h.WriteJsonHeader(w)
 	h.WriteEndpointsHeader(w, r)
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"tags": page, "total": total})
+}
 
-	fmt.Fprintf(w, string(tagsJson))
+// GetRepositoryTagResolve finds the newest tag matching a semantic version
+// constraint, prereleases are included unless prerelease=false.
+func (h *Handler) GetRepositoryTagResolve(w http.ResponseWriter, r *http.Request, p [][]string) {
+	repoName := p[0][2]
+	query := r.URL.Query()
 
-	logger.Infof("tags %s", string(tagsJson))
+	constraint, err := ParseSemVerConstraint(query.Get("constraint"))
+	if err != nil {
+		writeError(w, badRequest("%s", err))
+		return
+	}
+
+	tag, version, ok := h.store().ResolveSemVer(h.Namespace+"/"+repoName, constraint, query.Get("prerelease") != "false")
+	if !ok {
+		writeError(w, notFound("no tag of %s satisfies %s", repoName, query.Get("constraint")))
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	h.WriteEndpointsHeader(w, r)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"tag":      tag,
+		"image_id": h.repository(repoName).Tags()[tag],
+		"version":  version.String(),
+	})
 }
 
 func (h *Handler) PutImageResource(w http.ResponseWriter, r *http.Request, p [][]string) {
 	imageId := p[0][2]
 	tagName := p[0][3]
 
-	err := writeFile(h.DataDir+"/images/"+imageId+"/"+tagName, r.Body)
+	if !validImageId(imageId) {
+		writeError(w, badRequest("invalid image id %q", imageId))
+		return
+	}
+	// the registry's own files, like the layer checksum, can't be uploaded
+	switch tagName {
+	case "json", "layer", "checksum":
+	default:
+		writeError(w, notFound("no image resource %s", tagName))
+		return
+	}
+
+	limit := h.UploadLimits.Json
+	if tagName == "layer" {
+		limit = h.UploadLimits.Layer
+	}
+	if !h.limitBody(w, r, limit) {
+		return
+	}
+
+	// images uploaded as part of a push are staged until it completes
+	dir, staged := h.Pushes.ImageDir(requestToken(w, r), imageId)
+	if !staged {
+		dir = h.DataDir + "/images/" + imageId
+	}
+
+	var err error
+	switch tagName {
+	case "layer":
+		err = h.writeLayer(w, r, &Image{dir})
+	case "json":
+		err = writeFileOnce(dir+"/json", r.Body)
+	case "checksum":
+		err = writeFile(dir+"/checksum", r.Body)
+	}
 
 	if err != nil {
-		logger.Error(err.Error())
-	} else {
-		w.WriteHeader(http.StatusOK)
+		writeError(w, err)
+		return
+	}
+
+	if !staged {
+		h.Images.Add(imageId)
 	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeLayer stores a layer, charging it to the quota of the repository
+// being pushed with the request's session token. Layers uploaded outside a
+// push belong to no repository yet, so are only charged to the namespace.
+func (h *Handler) writeLayer(w http.ResponseWriter, r *http.Request, image *Image) error {
+	// the same layer uploaded again adds nothing
+	if _, err := os.Stat(image.LayerPath()); err == nil && !image.Corrupt() {
+		return image.WriteLayer(r.Body)
+	}
+
+	token := requestToken(w, r)
+	repo, pushing := h.Pushes.Repository(token)
+
+	upload, err := h.Quotas.Upload(h.Namespace, repo, r.ContentLength, r.Body)
+	if err != nil {
+		return err
+	}
+
+	err = image.WriteLayerWithin(upload, func(move func() error) error {
+		stored := upload.Finish()
+		if !pushing {
+			return h.Quotas.Commit(h.Namespace, repo, stored, move)
+		}
+		if err := move(); err != nil {
+			return err
+		}
+		if !h.Pushes.Charge(token, stored) {
+			// the push went away while the layer was uploaded
+			h.Quotas.Release(h.Namespace, repo, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		upload.Abort()
+	}
+	return err
 }
 
 func (h *Handler) PutRepositoryTags(w http.ResponseWriter, r *http.Request, p [][]string) {
 
-	repoName := p[0][2]
-	path := h.DataDir + "/repositories/" + repoName + "/tags/" + p[0][3]
+	repo := h.repository(p[0][2])
+	tag := p[0][3]
+	admin := h.requestIsAdmin(w, r)
+
+	if err := validateTagName(tag); err != nil {
+		writeError(w, err)
+		return
+	}
+	if !h.limitBody(w, r, h.UploadLimits.Tag) {
+		return
+	}
 
-	err := writeFile(path, r.Body)
+	value, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logger.Error(err.Error())
-	} else {
-		w.WriteHeader(http.StatusOK)
+		writeError(w, bodyError(err))
+		return
+	}
+
+	err = repo.CheckTagWrite(tag, tagImageId(value), admin)
+	// tags pushed along with images wait for the push to complete, where
+	// they are checked again
+	if err == nil && !h.Pushes.StageTag(requestToken(w, r), p[0][2], tag, value, h.tagHistoryEntry(w, r), admin) {
+		err = repo.WriteTag(tag, value, h.tagHistoryEntry(w, r), admin)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) DeleteRepositoryTag(w http.ResponseWriter, r *http.Request, p [][]string) {
+	repo := h.repository(p[0][2])
+	tag := p[0][3]
+
+	if _, ok := repo.Tags()[tag]; !ok {
+		writeError(w, notFound("tag %s not found", tag))
+		return
+	}
+
+	_, err := h.store().TrashTag(h.Namespace+"/"+p[0][2], tag, h.tagHistoryEntry(w, r), h.requestIsAdmin(w, r))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) GetRepositoryProtection(w http.ResponseWriter, r *http.Request, p [][]string) {
+	rules, err := h.repository(p[0][2]).ProtectionRules()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rules)
+}
+
+// PutRepositoryProtection replaces the tag protection rules of a repository
+// with the json list in the body.
+func (h *Handler) PutRepositoryProtection(w http.ResponseWriter, r *http.Request, p [][]string) {
+	repo := h.repository(p[0][2])
+	if _, err := os.Stat(repo.Dir); err != nil {
+		writeError(w, notFound("repository %s not found", p[0][2]))
+		return
+	}
+
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	rules := []*ProtectionRule{}
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		writeError(w, badRequest("invalid protection rules: %s", err))
+		return
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			writeError(w, badRequest("%s", err))
+			return
+		}
+	}
+
+	if err := repo.WriteProtectionRules(rules); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) tagHistoryEntry(w http.ResponseWriter, r *http.Request) *TagHistoryEntry {
+	return &TagHistoryEntry{User: h.requestLogin(w, r), RequestId: w.Header().Get("X-Request-ID")}
+}
+
+func (h *Handler) GetRepositoryTagHistory(w http.ResponseWriter, r *http.Request, p [][]string) {
+	history, err := h.repository(p[0][2]).TagHistory(p[0][3])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(history)
+}
+
+// PostRepositoryTagRollback re-points a tag at the image of the history
+// entry given by ?to=<index>, or at the one before the current image.
+func (h *Handler) PostRepositoryTagRollback(w http.ResponseWriter, r *http.Request, p [][]string) {
+	repoName, tag := p[0][2], p[0][3]
+
+	index := -1
+	if to := r.URL.Query().Get("to"); to != "" {
+		var err error
+		if index, err = strconv.Atoi(to); err != nil || index < 0 {
+			writeError(w, badRequest("to must be a history index"))
+			return
+		}
+	}
+
+	target, err := h.store().RollbackTarget(h.Namespace+"/"+repoName, tag, index)
+
+	entry := h.tagHistoryEntry(w, r)
+	if err == nil {
+		err = h.store().RollbackTag(h.Namespace+"/"+repoName, tag, target, entry, h.requestIsAdmin(w, r))
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entry)
 }
 
 func (h *Handler) PutRepositoryImages(w http.ResponseWriter, r *http.Request, p [][]string) {
 
 	repoName := p[0][2]
-	repo := &Repository{h.DataDir + "/repositories/" + repoName}
+	repo := h.repository(repoName)
 
-	err := writeFile(repo.ImagesPath(), r.Body)
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	images, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logger.Error(err.Error())
-	} else {
-		w.WriteHeader(http.StatusNoContent)
+		writeError(w, bodyError(err))
+		return
+	}
+
+	added, pushed, err := h.Pushes.Commit(requestToken(w, r), h.store(), repoName, images)
+	for _, id := range added {
+		h.Images.Add(id)
+	}
+	if !pushed && err == nil {
+		err = writeFile(repo.ImagesPath(), nopCloser(images))
 	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) PutRepository(w http.ResponseWriter, r *http.Request, p [][]string) {
 
 	repoName := p[0][2]
+	repo := h.repository(repoName)
+
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	index, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+
+	// a push's image list is only written once it completes
+	if token := requestToken(w, r); token != "" {
+		err = h.Pushes.Start(token, repoName, index)
+	} else {
+		err = writeFile(repo.IndexPath(), nopCloser(index))
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
 	h.WriteJsonHeader(w)
 	h.WriteEndpointsHeader(w, r)
 	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteRepository moves a repository into the trash.
+func (h *Handler) DeleteRepository(w http.ResponseWriter, r *http.Request, p [][]string) {
+	item, err := h.store().TrashRepository(h.Namespace+"/"+p[0][2], h.requestLogin(w, r))
+	if err == nil {
+		h.Quotas.Rescan()
+	}
+	h.writeTrashed(w, r, item, err)
+}
+
+// DeleteImage moves an image no tag refers to into the trash.
+func (h *Handler) DeleteImage(w http.ResponseWriter, r *http.Request, p [][]string) {
+	image, ok := h.resolveImage(w, r, p[0][2])
+	if !ok {
+		return
+	}
+
+	item, err := h.store().TrashImage(image.Id(), h.requestLogin(w, r))
+	if err == nil {
+		h.Images.Remove(image.Id())
+		h.Quotas.Rescan()
+	}
+	h.writeTrashed(w, r, item, err)
+}
+
+func (h *Handler) writeTrashed(w http.ResponseWriter, r *http.Request, item *TrashItem, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(item)
+}
+
+func (h *Handler) GetTrash(w http.ResponseWriter, r *http.Request, p [][]string) {
+	items, err := h.store().Trash()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(items)
+}
+
+// PostTrashRestore puts a trashed item back where it was deleted from.
+func (h *Handler) PostTrashRestore(w http.ResponseWriter, r *http.Request, p [][]string) {
+	item, err := h.store().Restore(p[0][2], h.tagHistoryEntry(w, r))
+	if err == nil {
+		if item.Kind == TrashImage {
+			h.Images.Add(item.ImageId)
+		}
+		h.Quotas.Rescan()
+	}
+	h.writeTrashed(w, r, item, err)
+}
+
+func (h *Handler) GetRevocations(w http.ResponseWriter, r *http.Request, p [][]string) {
+	h.writeRevocations(w)
+}
+
+// PostRevocations revokes the session with a token, the sessions of a login
+// issued before a time, now when none is given, or every session issued
+// before a time.
+func (h *Handler) PostRevocations(w http.ResponseWriter, r *http.Request, p [][]string) {
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	revoke := struct {
+		Token  string    `json:"token"`
+		Login  string    `json:"login"`
+		Before time.Time `json:"before"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&revoke); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+
+	var err error
+	switch {
+	case revoke.Token != "":
+		err = h.Revocations.RevokeToken(revoke.Token)
+	case revoke.Login != "":
+		if revoke.Before.IsZero() {
+			revoke.Before = time.Now()
+		}
+		err = h.Revocations.RevokeLogin(revoke.Login, revoke.Before)
+	case !revoke.Before.IsZero():
+		err = h.Revocations.RevokeBefore(revoke.Before)
+	default:
+		err = badRequest("give a token, login or before time to revoke")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	logger.Infof("%s revoked token=%t login=%q before=%s", h.requestLogin(w, r), revoke.Token != "", revoke.Login, revoke.Before)
+	h.writeRevocations(w)
+}
+
+func (h *Handler) writeRevocations(w http.ResponseWriter) {
+	list, err := h.Revocations.List()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(list)
+}
+
+// DeleteSession logs out, revoking the session token the request was made
+// with.
+func (h *Handler) DeleteSession(w http.ResponseWriter, r *http.Request, p [][]string) {
+	token := requestToken(w, r)
+	if token == "" || h.requestLogin(w, r) == "" {
+		writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "no session to log out of"))
+		return
+	}
+
+	if err := h.Revocations.RevokeToken(token); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTokens lists the access tokens of the login making the request, or
+// every token for admins.
+func (h *Handler) GetTokens(w http.ResponseWriter, r *http.Request, p [][]string) {
+	owner := h.requestLogin(w, r)
+	if h.requestIsAdmin(w, r) {
+		owner = ""
+	}
+
+	tokens, err := h.Tokens.List(owner)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// PostTokens creates an access token for the login making the request, or
+// for a robot account when an admin asks for one. The secret is only ever
+// given in this response.
+func (h *Handler) PostTokens(w http.ResponseWriter, r *http.Request, p [][]string) {
+	if !h.limitBody(w, r, h.UploadLimits.Json) {
+		return
+	}
+
+	token := &AccessToken{}
+	if err := json.NewDecoder(r.Body).Decode(token); err != nil {
+		writeError(w, bodyError(err))
+		return
+	}
+	if err := token.validate(); err != nil {
+		writeError(w, badRequest("%s", err))
+		return
+	}
+
+	token.CreatedBy = h.requestLogin(w, r)
+	token.Owner = token.CreatedBy
+	if token.Robot {
+		if !h.requestIsAdmin(w, r) {
+			writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "only admins create robot accounts"))
+			return
+		}
+		token.Owner = robotPrefix + token.Name
+	}
+
+	secret, err := h.Tokens.Create(token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		*AccessToken
+		Token string `json:"token"`
+	}{token, secret})
+}
+
+// DeleteToken deletes an access token of the login making the request, or
+// any token for admins, ending the sessions made with it.
+func (h *Handler) DeleteToken(w http.ResponseWriter, r *http.Request, p [][]string) {
+	token, err := h.Tokens.Get(p[0][2])
+	if err == nil && token.Owner != h.requestLogin(w, r) && !h.requestIsAdmin(w, r) {
+		err = ErrTokenNotFound
+	}
+	if err == nil {
+		err = h.Tokens.Delete(token.Id)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) GetQuotas(w http.ResponseWriter, r *http.Request, p [][]string) {
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.Quotas.Usage())
+}
 
-	repo := &Repository{h.DataDir + "/repositories/" + repoName}
+// GetRetention reports what the retention policies would expire without
+// changing anything.
+func (h *Handler) GetRetention(w http.ResponseWriter, r *http.Request, p [][]string) {
+	h.applyRetention(w, true)
+}
 
-	err := writeFile(repo.IndexPath(), r.Body)
+// PostRetention applies the retention policies straight away.
+func (h *Handler) PostRetention(w http.ResponseWriter, r *http.Request, p [][]string) {
+	h.applyRetention(w, false)
+}
 
+func (h *Handler) applyRetention(w http.ResponseWriter, dryRun bool) {
+	report, err := h.store().ApplyRetention(h.Retention, time.Hour, h.TrashRetention, dryRun)
+	if !dryRun {
+		report.forget(h.Images)
+		h.Quotas.Rescan()
+	}
 	if err != nil {
-		logger.Error(err.Error())
+		writeError(w, err)
+		return
 	}
+
+	h.WriteJsonHeader(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
 }
 
-func (h *Handler) RepoAuthenticator(w http.ResponseWriter, r *http.Request) bool {
+func (h *Handler) RepoAuthenticator(w http.ResponseWriter, r *http.Request, p [][]string) bool {
 
 	// if the Authorization header is present
 	if _, ok := r.Header["Authorization"]; ok {
 		session, err := h.Auth.CheckAuth(r)
 		if err != nil {
 			w.Header().Add("WWW-Authenticate", `Basic realm="docker-registry"`)
-			w.WriteHeader(http.StatusUnauthorized)
+			writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "%s", err))
 			return false
 		}
 
@@ -232,16 +988,117 @@ func (h *Handler) RepoAuthenticator(w http.ResponseWriter, r *http.Request) bool
 			w.Header().Add("WWW-Authenticate", `Token signature=123abc,repository="dynport/test",access=write`)
 			w.Header().Add("X-Docker-Token", session.Token)
 		}
+
+		if repo, access, ok := h.scopeAllows(r, session, p); !ok {
+			writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "access token doesn't grant %s access to %s", access, repo))
+			return false
+		}
+	}
+	return true
+}
+
+// AdminAuthenticator only lets through sessions belonging to one of Admins,
+// or any authenticated session when no admins are configured and everyone
+// shares the single user store's password.
+func (h *Handler) AdminAuthenticator(w http.ResponseWriter, r *http.Request, p [][]string) bool {
+	var session *Session
+	var err error
+
+	if _, ok := r.Header["Authorization"]; ok && h.Auth != nil {
+		session, err = h.Auth.CheckAuth(r)
+	}
+
+	if session == nil || err != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="docker-registry"`)
+		writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "authentication required"))
+		return false
+	}
+
+	if !h.isAdmin(session.Login) || session.TokenId != "" {
+		writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "%s is not an admin", session.Login))
+		return false
+	}
+	return true
+}
+
+// LoginAuthenticator only lets through sessions made by logging in with a
+// password rather than an access token.
+func (h *Handler) LoginAuthenticator(w http.ResponseWriter, r *http.Request, p [][]string) bool {
+	var session *Session
+	var err error
+
+	if _, ok := r.Header["Authorization"]; ok && h.Auth != nil {
+		session, err = h.Auth.CheckAuth(r)
+	}
+
+	if session == nil || err != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="docker-registry"`)
+		writeError(w, NewApiError(http.StatusUnauthorized, CodeUnauthorized, "authentication required"))
+		return false
+	}
+
+	if session.TokenId != "" {
+		writeError(w, NewApiError(http.StatusForbidden, CodeForbidden, "access tokens can't be used here, log in with a password"))
+		return false
+	}
+
+	// lets the handler find the session of a basic auth request
+	if session.Status == SessionNew {
+		w.Header().Add("X-Docker-Token", session.Token)
 	}
 	return true
 }
 
-func (h *Handler) NoopAuthenticator(w http.ResponseWriter, r *http.Request) bool {
+// scopeAllows checks the scopes of a session made with an access token
+// cover the request, pulls need pull access and anything else push. Images
+// aren't named by repository, uploads count against the repository being
+// pushed and reads need pull access to some repository. The repository is
+// the one the route captured, so it is the one the handler acts on.
+func (h *Handler) scopeAllows(r *http.Request, session *Session, p [][]string) (repo, access string, ok bool) {
+	if session.TokenId == "" {
+		return "", "", true
+	}
+
+	access = "push"
+	if r.Method == "GET" || r.Method == "HEAD" {
+		access = "pull"
+	}
+
+	switch {
+	case repositoryPathRegexp.MatchString(r.URL.Path):
+		repo = h.Namespace + "/" + p[0][2]
+	case imagePathRegexp.MatchString(r.URL.Path):
+		if pushing, ok := h.Pushes.Repository(session.Token); ok && access == "push" {
+			repo = h.Namespace + "/" + pushing
+		}
+	default:
+		return "", access, true
+	}
+	return repo, access, scopesAllow(session.Scopes, repo, access)
+}
+
+// isAdmin is true for logins listed in Admins. Without any listed every
+// login is an admin, unless accounts are kept in a store users can be added
+// to, where nobody is.
+func (h *Handler) isAdmin(login string) bool {
+	if len(h.Admins) == 0 {
+		_, writable := h.Users.(WritableUserStore)
+		return !writable
+	}
+	for _, admin := range h.Admins {
+		if admin == login {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Handler) NoopAuthenticator(w http.ResponseWriter, r *http.Request, p [][]string) bool {
 	return true
 }
 
 func (h *Handler) Map(t, re string, authenticator HttpAuthHandler, handler HttpRouteHandler) {
-	h.Mappings = append(h.Mappings, &Mapping{t, regexp.MustCompile("/v(\\d+)/" + re), authenticator, handler})
+	h.Mappings = append(h.Mappings, &Mapping{t, regexp.MustCompile("^/v(\\d+)/" + re), authenticator, handler})
 }
 
 func (h *Handler) doHandle(w http.ResponseWriter, r *http.Request) (ok bool) {
@@ -250,8 +1107,8 @@ func (h *Handler) doHandle(w http.ResponseWriter, r *http.Request) (ok bool) {
 		if r.Method != mapping.Method {
 			continue
 		}
-		if res := mapping.Regexp.FindAllStringSubmatch(r.URL.String(), -1); len(res) > 0 {
-			if ok := mapping.Authenticator(w, r); ok {
+		if res := mapping.Regexp.FindAllStringSubmatch(r.URL.Path, -1); len(res) > 0 {
+			if ok := mapping.Authenticator(w, r, res); ok {
 				mapping.Handler(w, r, res)
 			}
 			return true
@@ -271,32 +1128,83 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// logger.Info(fmt.Sprintf("%s got request %s %s", uuid, r.Method, r.URL.String()))
 	// logger.Info(spew.Sprintf("headers %v", r.Header))
 
+	if r.Method == "PUT" || r.Method == "POST" {
+		r.Body = newUploadBody(w, r, h.ChunkTimeout)
+	}
+
 	if ok := h.doHandle(w, r); !ok {
-		http.NotFound(w, r)
+		writeError(w, notFound("no route for %s %s", r.Method, r.URL.Path))
 	}
 	logger.Info(fmt.Sprintf("%s finished request in %.06f", uuid, time.Now().Sub(started).Seconds()))
 }
 
 func NewHandler(dataDir, namespace string, auth UserAuth) (handler *Handler) {
 	handler = &Handler{DataDir: dataDir, Namespace: namespace, Mappings: make([]*Mapping, 0), Auth: auth}
+	handler.Images = NewImageIndex(dataDir + "/images")
+	handler.Pushes = NewPushes(dataDir + "/_staging")
+	handler.Pushes.Namespace = namespace
+	handler.Quotas = NewQuotas(dataDir, namespace, map[string]int64{})
+	handler.TrashRetention = 7 * 24 * time.Hour
+	handler.UploadLimits = UploadLimits{Json: 1 << 20, Tag: 1 << 10}
+	handler.Cache = NewMemorySessionStore()
+	handler.Revocations = handler.store().Revocations()
+	handler.Tokens = handler.store().AccessTokens()
+	if basic, ok := auth.(*BasicAuth); ok {
+		handler.Users = basic.Users
+		if basic.Revocations == nil {
+			handler.Revocations.TTL = basic.TTL
+			basic.Revocations = handler.Revocations
+		}
+		if basic.Tokens == nil {
+			basic.Tokens = handler.Tokens
+		}
+	}
+	handler.Pushes.Quotas = handler.Quotas
 
-	// dummies
+	// ping and accounts
 	handler.Map("GET", "_ping", handler.NoopAuthenticator, handler.GetPing)
 	handler.Map("GET", "users", handler.RepoAuthenticator, handler.GetUsers)
 	handler.Map("POST", "users/$", handler.NoopAuthenticator, handler.PostUsers)
+	handler.Map("PUT", "users/(.*?)/$", handler.LoginAuthenticator, handler.PutUser)
+
+	// admin
+	handler.Map("GET", "_admin/quotas", handler.AdminAuthenticator, handler.GetQuotas)
+	handler.Map("GET", "_admin/metrics", handler.AdminAuthenticator, handler.GetMetrics)
+	handler.Map("GET", "_admin/retention", handler.AdminAuthenticator, handler.GetRetention)
+	handler.Map("POST", "_admin/retention", handler.AdminAuthenticator, handler.PostRetention)
+	handler.Map("GET", "_admin/trash$", handler.AdminAuthenticator, handler.GetTrash)
+	handler.Map("POST", "_admin/trash/(.*?)/_restore", handler.AdminAuthenticator, handler.PostTrashRestore)
+	handler.Map("GET", "_admin/revocations", handler.AdminAuthenticator, handler.GetRevocations)
+	handler.Map("POST", "_admin/revocations", handler.AdminAuthenticator, handler.PostRevocations)
+
+	// sessions
+	handler.Map("DELETE", "_session$", handler.RepoAuthenticator, handler.DeleteSession)
+	handler.Map("GET", "_tokens$", handler.LoginAuthenticator, handler.GetTokens)
+	handler.Map("POST", "_tokens$", handler.LoginAuthenticator, handler.PostTokens)
+	handler.Map("DELETE", "_tokens/(.*?)$", handler.LoginAuthenticator, handler.DeleteToken)
 
 	// images
 	handler.Map("GET", "images/(.*?)/ancestry", handler.RepoAuthenticator, handler.GetImageAncestry)
 
 	handler.Map("GET", "images/(.*?)/layer", handler.RepoAuthenticator, handler.GetImageLayer)
 	handler.Map("GET", "images/(.*?)/json", handler.RepoAuthenticator, handler.GetImageJson)
+	handler.Map("GET", "images/(.*?)/inspect", handler.RepoAuthenticator, handler.GetImageInspect)
 	handler.Map("PUT", "images/(.*?)/(.*)", handler.RepoAuthenticator, handler.PutImageResource)
+	handler.Map("DELETE", "images/(.*?)/$", handler.AdminAuthenticator, handler.DeleteImage)
 
 	// repositories
+	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/tags/_detail", namespace), handler.RepoAuthenticator, handler.GetRepositoryTagDetails)
+	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/tags/_resolve", namespace), handler.RepoAuthenticator, handler.GetRepositoryTagResolve)
+	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/tags/(.*?)/_history", namespace), handler.RepoAuthenticator, handler.GetRepositoryTagHistory)
 	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/tags", namespace), handler.RepoAuthenticator, handler.GetRepositoryTags)
 	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/images", namespace), handler.RepoAuthenticator, handler.GetRepositoryImages)
+	handler.Map("GET", fmt.Sprintf("repositories/%s/(.*?)/_protection", namespace), handler.RepoAuthenticator, handler.GetRepositoryProtection)
+	handler.Map("PUT", fmt.Sprintf("repositories/%s/(.*?)/_protection", namespace), handler.AdminAuthenticator, handler.PutRepositoryProtection)
 	handler.Map("PUT", fmt.Sprintf("repositories/%s/(.*?)/tags/(.*)", namespace), handler.RepoAuthenticator, handler.PutRepositoryTags)
+	handler.Map("DELETE", fmt.Sprintf("repositories/%s/(.*?)/tags/(.*)", namespace), handler.RepoAuthenticator, handler.DeleteRepositoryTag)
+	handler.Map("POST", fmt.Sprintf("repositories/%s/(.*?)/tags/(.*?)/_rollback", namespace), handler.RepoAuthenticator, handler.PostRepositoryTagRollback)
 	handler.Map("PUT", fmt.Sprintf("repositories/%s/(.*?)/images", namespace), handler.RepoAuthenticator, handler.PutRepositoryImages)
 	handler.Map("PUT", fmt.Sprintf("repositories/%s/(.*?)/$", namespace), handler.RepoAuthenticator, handler.PutRepository)
+	handler.Map("DELETE", fmt.Sprintf("repositories/%s/(.*?)/$", namespace), handler.AdminAuthenticator, handler.DeleteRepository)
 	return
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -57,6 +58,25 @@ func (t *testSuite) TestImage() {
 	t.Equal("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", ancestry[2])
 }
 
+func (t *testSuite) TestImageUnexpectedJson() {
+	store := &Store{copyFixtures()}
+	id := "e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"
+	t.Nil(writeFile(store.Image(id).Dir+"/json", nopCloser([]byte(
+		`{"id": "`+id+`", "parent": "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", "Size": "big", "config": {"Memory": "1g"}}`))))
+
+	// only describing the image needs the whole model
+	_, err := store.Image(id).Inspect()
+	t.True(err != nil)
+
+	t.Equal(3, len(store.Image(id).Ancestry()))
+	report, err := store.Fsck(false)
+	t.Nil(err)
+	t.Equal(0, len(report.Problems))
+	referenced, err := store.ReferencedImages()
+	t.Nil(err)
+	t.Equal(3, len(referenced))
+}
+
 func resetTmpDataDir() string {
 	dir, _ := os.Getwd()
 	dataDir := dir + "/tmp/data"
@@ -66,7 +86,7 @@ func resetTmpDataDir() string {
 }
 
 func (t *testSuite) TestWriteImageResource() {
-	h := NewHandler(resetTmpDataDir(), nil)
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
 	ser := httptest.NewServer(h)
 	defer ser.Close()
 
@@ -85,7 +105,7 @@ func (t *testSuite) TestWriteImageResource() {
 }
 
 func (t *testSuite) TestPutRepositoryTag() {
-	h := NewHandler(resetTmpDataDir(), nil)
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
 	ser := httptest.NewServer(h)
 	defer ser.Close()
 
@@ -103,8 +123,28 @@ func (t *testSuite) TestPutRepositoryTag() {
 	t.Equal("thetag", string(data))
 }
 
+func (t *testSuite) TestPutRepositoryTagNames() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	put := func(tag string) int {
+		req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/test/tags/"+tag, bytes.NewReader([]byte(`"abc"`)))
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(200, put("v1.tmp"))
+	t.Equal("abc", h.repository("test").Tags()["v1.tmp"])
+	t.Equal(400, put(".v1.tmp"))
+	t.Equal(400, put("-v1"))
+	t.Equal(1, len(h.repository("test").Tags()))
+}
+
 func (t *testSuite) TestPutRepositoryImages() {
-	h := NewHandler(resetTmpDataDir(), nil)
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
 	ser := httptest.NewServer(h)
 	defer ser.Close()
 
@@ -123,7 +163,7 @@ func (t *testSuite) TestPutRepositoryImages() {
 }
 
 func (t *testSuite) TestGetImageJson() {
-	h := NewHandler(resetTmpDataDir(), nil)
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
 	ser := httptest.NewServer(h)
 	defer ser.Close()
 
@@ -136,7 +176,7 @@ func (t *testSuite) TestGetImageJson() {
 }
 
 func (t *testSuite) TestPutRepository() {
-	h := NewHandler(resetTmpDataDir(), nil)
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
 	ser := httptest.NewServer(h)
 	defer ser.Close()
 
@@ -158,7 +198,7 @@ func (t *testSuite) TestPutRepository() {
 func (t *testSuite) TestReadFromServer() {
 	dir, _ := os.Getwd()
 	dataDir := dir + "/fixtures/index"
-	ser := httptest.NewServer(NewHandler(dataDir, nil))
+	ser := httptest.NewServer(NewHandler(dataDir, "dynport", nil))
 	defer ser.Close()
 
 	r, _ := http.Get(ser.URL + "/v1/_ping")
@@ -176,6 +216,126 @@ func (t *testSuite) TestReadFromServer() {
 	t.Equal(200, r.StatusCode)
 }
 
+func (t *testSuite) TestImageIndexResolve() {
+	dir, _ := os.Getwd()
+	index := NewImageIndex(dir + "/fixtures/index/images")
+
+	id, err := index.Resolve("e0ac")
+	t.Nil(err)
+	t.Equal("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", id)
+
+	_, err = index.Resolve("ffff")
+	t.Equal(ErrImageNotFound, err)
+
+	_, err = index.Resolve("../images")
+	t.Equal(ErrImageNotFound, err)
+}
+
+func (t *testSuite) TestAmbiguousImagePrefix() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	client := http.Client{}
+	for _, id := range []string{"abc123", "abc456"} {
+		req, _ := http.NewRequest("PUT", ser.URL+"/v1/images/"+id+"/json", bytes.NewReader([]byte("{}")))
+		client.Do(req)
+	}
+
+	r, _ := http.Get(ser.URL + "/v1/images/abc/json")
+	t.Equal(409, r.StatusCode)
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	t.True(bytes.Contains(body, []byte("abc123")))
+	t.True(bytes.Contains(body, []byte("abc456")))
+
+	r, _ = http.Get(ser.URL + "/v1/images/abc4/json")
+	t.Equal(200, r.StatusCode)
+
+	r, _ = http.Get(ser.URL + "/v1/images/abd/layer")
+	t.Equal(404, r.StatusCode)
+}
+
+func (t *testSuite) TestGetImageLayerRange() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	client := http.Client{}
+	req, _ := http.NewRequest("PUT", ser.URL+"/v1/images/abc123/layer", bytes.NewReader([]byte("0123456789")))
+	client.Do(req)
+
+	req, _ = http.NewRequest("GET", ser.URL+"/v1/images/abc123/layer", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	r, _ := client.Do(req)
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	t.Equal(206, r.StatusCode)
+	t.Equal("234", string(body))
+	t.Equal("public, max-age=31536000, immutable", r.Header.Get("Cache-Control"))
+
+	etag := r.Header.Get("ETag")
+	t.Equal(`"sha256:84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"`, etag)
+
+	req, _ = http.NewRequest("GET", ser.URL+"/v1/images/abc123/layer", nil)
+	req.Header.Set("If-None-Match", etag)
+	r, _ = client.Do(req)
+	t.Equal(304, r.StatusCode)
+}
+
+func (t *testSuite) TestPutImageResourceNames() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	put := func(path, body string) int {
+		req, _ := http.NewRequest("PUT", ser.URL+path, bytes.NewReader([]byte(body)))
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(200, put("/v1/images/abc123/layer", "0123456789"))
+	t.Equal(200, put("/v1/images/abc123/checksum", "tarsum+sha256:abc"))
+
+	// the registry's own files can't be written by clients
+	t.Equal(404, put("/v1/images/abc123/_checksum", "sha256:bogus"))
+	t.Equal(404, put("/v1/images/abc123/_corrupt", "bogus"))
+	t.Equal(404, put("/v1/images/abc123/json/extra", "{}"))
+	image := h.store().Image("abc123")
+	t.False(image.Corrupt())
+	sum, _ := image.Checksum()
+	t.Equal("sha256:84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", sum)
+
+	t.Equal(400, put("/v1/images/%2e%2e/json", "{}"))
+	_, err := os.Stat(h.DataDir + "/json")
+	t.True(os.IsNotExist(err))
+}
+
+func (t *testSuite) TestGetImageInspect() {
+	dir, _ := os.Getwd()
+	ser := httptest.NewServer(NewHandler(dir+"/fixtures/index", "dynport", nil))
+	defer ser.Close()
+
+	r, _ := http.Get(ser.URL + "/v1/images/e0ac/inspect")
+	t.Equal(200, r.StatusCode)
+
+	inspection := &ImageInspection{}
+	json.NewDecoder(r.Body).Decode(inspection)
+	r.Body.Close()
+
+	t.Equal("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", inspection.Parent)
+	t.Equal("x86_64", inspection.Architecture)
+	t.Equal([]string{"/bin/sh", "-c", "apt-get install -y redis-server"}, inspection.ContainerConfig.Cmd)
+	t.Equal(2013, inspection.Created.Year())
+	t.Equal(int64(34795256), inspection.Size)
+	t.Equal(int64(34795256+144519634+131502179), inspection.TotalSize)
+	t.Equal(int64(93), inspection.StoredSize)
+	t.Equal(int64(3*93), inspection.TotalStoredSize)
+	t.Equal(3, len(inspection.Ancestry))
+}
+
 func (t *testSuite) TestBasicServer() {
 	users := NewSingleUserStore("test1234asdfg")
 
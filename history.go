@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var ErrNoEarlierTag = errors.New("no earlier image to roll back to")
+
+// rollbackError explains why a history entry can't be rolled back to.
+type rollbackError struct {
+	message string
+}
+
+func (e *rollbackError) Error() string {
+	return e.message
+}
+
+// TagHistoryEntry records one change to where a tag points.
+type TagHistoryEntry struct {
+	Index     int       `json:"index"`
+	Action    string    `json:"action"`
+	ImageId   string    `json:"image_id"`
+	User      string    `json:"user,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestId string    `json:"request_id,omitempty"`
+}
+
+func (r *Repository) TagHistoryPath(tag string) string {
+	return r.Dir + "/_history/" + tag
+}
+
+// SetTag points tag at the image named in value, the json string docker
+// pushes, recording who did it in the tag's metadata and history.
+func (r *Repository) SetTag(tag string, value []byte, entry *TagHistoryEntry) error {
+	unlock := lockPath(r.TagPath(tag))
+	defer unlock()
+	return r.setTag(tag, value, entry)
+}
+
+// WriteTag is SetTag for when the protection rules apply, the tag and the
+// rules stay locked from the check to the write so concurrent writes can't
+// both pass.
+func (r *Repository) WriteTag(tag string, value []byte, entry *TagHistoryEntry, admin bool) error {
+	unlock := r.lockTags([]string{tag})
+	defer unlock()
+
+	if err := r.CheckTagWrite(tag, tagImageId(value), admin); err != nil {
+		return err
+	}
+	return r.setTag(tag, value, entry)
+}
+
+// lockTags locks tags, in order so two callers can't each hold a tag the
+// other is waiting for, and then the protection rules, which can't change
+// until the returned function releases everything.
+func (r *Repository) lockTags(tags []string) func() {
+	paths := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !seen[tag] {
+			seen[tag] = true
+			paths = append(paths, r.TagPath(tag))
+		}
+	}
+	sort.Strings(paths)
+	paths = append(paths, r.ProtectionPath())
+
+	unlocks := []func(){}
+	for _, path := range paths {
+		unlocks = append(unlocks, lockPath(path))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// setTag writes the tag, the caller holds its lock.
+func (r *Repository) setTag(tag string, value []byte, entry *TagHistoryEntry) error {
+	tmpName, _, err := writeTemp(r.TagPath(tag), nopCloser(value))
+	if err != nil {
+		return err
+	}
+	if err := commitTemp(tmpName, r.TagPath(tag)); err != nil {
+		return err
+	}
+
+	entry.ImageId = tagImageId(value)
+	if entry.Action == "" {
+		entry.Action = "set"
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	if err := r.WriteTagMeta(tag, &TagMeta{PushedBy: entry.User, PushedAt: entry.Timestamp}); err != nil {
+		return err
+	}
+	return r.appendTagHistory(tag, entry)
+}
+
+// appendTagHistory adds an entry as a line of json, the history is only ever
+// appended to.
+func (r *Repository) appendTagHistory(tag string, entry *TagHistoryEntry) error {
+	path := r.TagHistoryPath(tag)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// TagHistory returns the changes made to a tag, oldest first.
+func (r *Repository) TagHistory(tag string) ([]*TagHistoryEntry, error) {
+	file, err := os.Open(r.TagHistoryPath(tag))
+	if os.IsNotExist(err) {
+		return []*TagHistoryEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	history := []*TagHistoryEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := &TagHistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, err
+		}
+		entry.Index = len(history)
+		history = append(history, entry)
+	}
+	return history, scanner.Err()
+}
+
+// RollbackTarget returns the history entry at index of a tag of the named
+// repository, or when index is negative the most recent one pointing at an
+// image other than the current.
+func (s *Store) RollbackTarget(name, tag string, index int) (*TagHistoryEntry, error) {
+	repo := s.Repository(name)
+
+	history, err := repo.TagHistory(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *TagHistoryEntry
+	if index >= 0 {
+		if index >= len(history) {
+			return nil, &rollbackError{fmt.Sprintf("tag %s has no history entry %d", tag, index)}
+		}
+		target = history[index]
+	} else {
+		current := repo.Tags()[tag]
+		for i := len(history) - 1; i >= 0 && target == nil; i-- {
+			if history[i].ImageId != current && history[i].ImageId != "" {
+				target = history[i]
+			}
+		}
+		if target == nil {
+			return nil, ErrNoEarlierTag
+		}
+	}
+
+	if target.ImageId == "" {
+		return nil, &rollbackError{fmt.Sprintf("history entry %d of %s doesn't point at an image", target.Index, tag)}
+	}
+	if _, err := os.Stat(s.Image(target.ImageId).Dir + "/json"); err != nil {
+		return nil, &rollbackError{fmt.Sprintf("image %s of history entry %d no longer exists", target.ImageId, target.Index)}
+	}
+	return target, nil
+}
+
+// RollbackTag re-points a tag of the named repository at the image of the
+// target history entry, when the protection rules allow it.
+func (s *Store) RollbackTag(name, tag string, target, entry *TagHistoryEntry, admin bool) error {
+	entry.Action = fmt.Sprintf("rollback to %d", target.Index)
+	return s.Repository(name).WriteTag(tag, []byte(`"`+target.ImageId+`"`), entry, admin)
+}
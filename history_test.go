@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func (t *testSuite) TestTagHistoryAndRollback() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	client := http.Client{}
+	for _, id := range []string{"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8"} {
+		req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/redis/tags/stable", bytes.NewReader([]byte(`"`+id+`"`)))
+		req.SetBasicAuth("mark", "pass")
+		client.Do(req)
+	}
+
+	history := []*TagHistoryEntry{}
+	r, _ := http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/stable/_history")
+	t.Equal(200, r.StatusCode)
+	json.NewDecoder(r.Body).Decode(&history)
+	r.Body.Close()
+
+	t.Equal(2, len(history))
+	t.Equal("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", history[0].ImageId)
+	t.Equal("mark", history[1].User)
+	t.Equal(1, history[1].Index)
+	t.True(history[1].RequestId != "")
+
+	req, _ := http.NewRequest("POST", ser.URL+"/v1/repositories/dynport/redis/tags/stable/_rollback", nil)
+	r, _ = client.Do(req)
+	t.Equal(200, r.StatusCode)
+	t.Equal("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", h.repository("redis").Tags()["stable"])
+
+	req, _ = http.NewRequest("POST", ser.URL+"/v1/repositories/dynport/redis/tags/stable/_rollback?to=1", nil)
+	r, _ = client.Do(req)
+	t.Equal(200, r.StatusCode)
+	t.Equal("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", h.repository("redis").Tags()["stable"])
+
+	req, _ = http.NewRequest("POST", ser.URL+"/v1/repositories/dynport/redis/tags/stable/_rollback?to=9", nil)
+	r, _ = client.Do(req)
+	t.Equal(409, r.StatusCode)
+
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(h.store(), out, []string{"tag", "history", "dynport/redis", "stable"}))
+	t.Equal(4, strings.Count(out.String(), "\n"))
+	t.True(strings.Contains(out.String(), "rollback to 0"))
+
+	t.Nil(runCommand(h.store(), out, []string{"tag", "rollback", "dynport/redis", "stable", "0"}))
+	t.Equal("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", h.repository("redis").Tags()["stable"])
+}
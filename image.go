@@ -1,9 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Image struct {
@@ -18,35 +25,244 @@ func (i *Image) LayerPath() (id string) {
 	return i.Dir + "/layer"
 }
 
+func (i *Image) ChecksumPath() string {
+	return i.Dir + "/_checksum"
+}
+
+// WriteLayer stores the layer and records its checksum alongside it. A layer
+// is only written once, unless it has been found corrupt.
+func (i *Image) WriteLayer(r io.ReadCloser) error {
+	return i.WriteLayerWithin(r, func(move func() error) error {
+		return move()
+	})
+}
+
+// WriteLayerWithin is WriteLayer with the uploaded layer moved into place by
+// within, for callers which need that step done under a lock of their own.
+func (i *Image) WriteLayerWithin(r io.ReadCloser, within func(move func() error) error) error {
+	if i.Corrupt() {
+		os.Remove(i.LayerPath())
+		os.Remove(i.ChecksumPath())
+	}
+
+	tmpName, sum, err := writeTemp(i.LayerPath(), r)
+	if err != nil {
+		return err
+	}
+	if err := within(func() error { return commitTempOnce(tmpName, sum, i.LayerPath()) }); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	os.Remove(i.CorruptPath())
+
+	return writeFile(i.ChecksumPath(), ioutil.NopCloser(strings.NewReader(sum)))
+}
+
+// Checksum returns the recorded checksum of the layer, computing and recording
+// it for layers stored before checksums were kept.
+func (i *Image) Checksum() (string, error) {
+	if data, err := ioutil.ReadFile(i.ChecksumPath()); err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	sum, err := i.LayerChecksum()
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFile(i.ChecksumPath(), ioutil.NopCloser(strings.NewReader(sum))); err != nil {
+		logger.Error(err.Error())
+	}
+	return sum, nil
+}
+
+// LayerChecksum hashes the layer as it is currently stored on disk.
+func (i *Image) LayerChecksum() (string, error) {
+	file, err := os.Open(i.LayerPath())
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return readChecksum(file)
+}
+
+func (i *Image) CorruptPath() string {
+	return i.Dir + "/_corrupt"
+}
+
+// Corrupt reports whether the layer has been found not to match its checksum.
+func (i *Image) Corrupt() bool {
+	_, err := os.Stat(i.CorruptPath())
+	return err == nil
+}
+
+func (i *Image) MarkCorrupt(reason string) error {
+	return writeFile(i.CorruptPath(), ioutil.NopCloser(strings.NewReader(reason)))
+}
+
+// ModTime returns when the image or any of its files last changed.
+func (i *Image) ModTime() (t time.Time) {
+	filepath.Walk(i.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+		return nil
+	})
+	return
+}
+
 func (i *Image) Ancestry() (a []string) {
+	a, err := i.AncestryChain()
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+// AncestryChain follows the parents of the image, returning the chain found
+// so far along with an error when an ancestor can't be read.
+func (i *Image) AncestryChain() (a []string, err error) {
 	a = []string{i.Id()}
+	seen := map[string]bool{i.Id(): true}
 	current := i
 	for {
-		atts, err := current.Attributes()
+		atts, err := current.Header()
 		if err != nil {
-			logger.Error(err.Error())
-			break
+			return a, err
 		}
-		if atts.Parent != "" {
-			a = append(a, atts.Parent)
-			current = &Image{filepath.Dir(current.Dir) + "/" + atts.Parent}
-		} else {
-			break
+		if atts.Parent == "" {
+			return a, nil
 		}
+		if seen[atts.Parent] {
+			return a, fmt.Errorf("ancestry of %s loops at %s", i.Id(), atts.Parent)
+		}
+		seen[atts.Parent] = true
+		a = append(a, atts.Parent)
+		current = &Image{filepath.Dir(current.Dir) + "/" + atts.Parent}
 	}
+}
+
+// ImageHeader is the part of the image json the registry itself relies on.
+// It is read on its own so a field of the rest the full model doesn't
+// expect can't break ancestry, gc, fsck or pushes.
+type ImageHeader struct {
+	Id     string `json:"id"`
+	Parent string `json:"parent,omitempty"`
+}
+
+func (i *Image) Header() (h *ImageHeader, err error) {
+	h = &ImageHeader{}
+	err = i.readJson(h)
 	return
 }
 
+// Attributes reads the whole image json, which fails on anything the model
+// doesn't expect, so is only used to describe images.
 func (i *Image) Attributes() (a *ImageAttributes, err error) {
 	a = &ImageAttributes{}
+	err = i.readJson(a)
+	return
+}
+
+func (i *Image) readJson(v interface{}) error {
 	path := i.Dir + "/json"
 	logger.Debug("reading attributes from path", path)
-	if data, err := ioutil.ReadFile(path); err == nil {
-		err = json.Unmarshal(data, a)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
 	}
-	return
+	return json.Unmarshal(data, v)
 }
 
+// ImageAttributes is the image json as pushed by docker.
 type ImageAttributes struct {
-	Id, Parent, Container string
+	Id              string       `json:"id"`
+	Parent          string       `json:"parent,omitempty"`
+	Comment         string       `json:"comment,omitempty"`
+	Created         time.Time    `json:"created"`
+	Container       string       `json:"container,omitempty"`
+	ContainerConfig *ImageConfig `json:"container_config,omitempty"`
+	DockerVersion   string       `json:"docker_version,omitempty"`
+	Author          string       `json:"author,omitempty"`
+	Config          *ImageConfig `json:"config,omitempty"`
+	Architecture    string       `json:"architecture,omitempty"`
+	Os              string       `json:"os,omitempty"`
+	Size            int64        `json:"Size"`
+}
+
+type ImageConfig struct {
+	Hostname        string
+	Domainname      string `json:",omitempty"`
+	User            string
+	Memory          int64
+	MemorySwap      int64
+	CpuShares       int64
+	Cpuset          string `json:",omitempty"`
+	AttachStdin     bool
+	AttachStdout    bool
+	AttachStderr    bool
+	PortSpecs       []string
+	ExposedPorts    map[string]struct{} `json:",omitempty"`
+	Tty             bool
+	OpenStdin       bool
+	StdinOnce       bool
+	Env             []string
+	Cmd             []string
+	Dns             []string `json:",omitempty"`
+	Image           string
+	Volumes         map[string]struct{}
+	VolumesFrom     string `json:",omitempty"`
+	WorkingDir      string `json:",omitempty"`
+	Entrypoint      []string
+	NetworkDisabled bool              `json:",omitempty"`
+	OnBuild         []string          `json:",omitempty"`
+	Labels          map[string]string `json:",omitempty"`
+}
+
+// ImageInspection is the image json along with the sizes stored for it
+// and its ancestry.
+type ImageInspection struct {
+	*ImageAttributes
+	StoredSize      int64    `json:"stored_size"`
+	Ancestry        []string `json:"ancestry"`
+	TotalSize       int64    `json:"total_size"`
+	TotalStoredSize int64    `json:"total_stored_size"`
+}
+
+// Inspect reads the image's attributes and totals the sizes of every image
+// in its ancestry.
+func (i *Image) Inspect() (*ImageInspection, error) {
+	atts, err := i.Attributes()
+	if err != nil {
+		return nil, err
+	}
+
+	ancestry, err := i.AncestryChain()
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &ImageInspection{ImageAttributes: atts, StoredSize: fileSize(i.LayerPath()), Ancestry: ancestry}
+	for _, id := range ancestry {
+		ancestor := &Image{filepath.Dir(i.Dir) + "/" + id}
+		ancestorAtts, err := ancestor.Attributes()
+		if err != nil {
+			return nil, err
+		}
+		inspection.TotalSize += ancestorAtts.Size
+		inspection.TotalStoredSize += fileSize(ancestor.LayerPath())
+	}
+	return inspection, nil
+}
+
+func readChecksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hashString(hash.Sum(nil)), nil
+}
+
+func hashString(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
 }
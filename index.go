@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the most candidates reported back when a prefix is ambiguous
+const maxCandidates = 10
+
+var ErrImageNotFound = errors.New("image not found")
+
+type AmbiguousImageError struct {
+	Prefix     string
+	Candidates []string
+}
+
+func (e *AmbiguousImageError) Error() string {
+	return fmt.Sprintf("image id prefix %s is ambiguous, matches %s", e.Prefix, strings.Join(e.Candidates, ", "))
+}
+
+// ImageIndex keeps a sorted list of the image ids stored under Dir so
+// prefixes can be resolved without globbing the directory on every request.
+type ImageIndex struct {
+	sync.RWMutex
+	Dir string
+	ids []string
+}
+
+func NewImageIndex(dir string) *ImageIndex {
+	index := &ImageIndex{Dir: dir}
+	if err := index.Load(); err != nil && !os.IsNotExist(err) {
+		logger.Error(err.Error())
+	}
+	return index
+}
+
+// Load replaces the index with the image directories currently on disk.
+func (x *ImageIndex) Load() error {
+	infos, err := ioutil.ReadDir(x.Dir)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	sort.Strings(ids)
+
+	x.Lock()
+	x.ids = ids
+	x.Unlock()
+	return nil
+}
+
+func (x *ImageIndex) Add(id string) {
+	x.Lock()
+	defer x.Unlock()
+	i := sort.SearchStrings(x.ids, id)
+	if i < len(x.ids) && x.ids[i] == id {
+		return
+	}
+	x.ids = append(x.ids, "")
+	copy(x.ids[i+1:], x.ids[i:])
+	x.ids[i] = id
+}
+
+func (x *ImageIndex) Remove(id string) {
+	x.Lock()
+	defer x.Unlock()
+	i := sort.SearchStrings(x.ids, id)
+	if i < len(x.ids) && x.ids[i] == id {
+		x.ids = append(x.ids[:i], x.ids[i+1:]...)
+	}
+}
+
+// Resolve returns the single image id starting with prefix, ErrImageNotFound
+// when there is none and an AmbiguousImageError when several match.
+func (x *ImageIndex) Resolve(prefix string) (string, error) {
+	if !validImageId(prefix) {
+		return "", ErrImageNotFound
+	}
+
+	matches := x.present(x.lookup(prefix))
+
+	// images written by another process are picked up when asked for in full
+	if len(matches) == 0 {
+		if info, err := os.Stat(filepath.Join(x.Dir, prefix)); err == nil && info.IsDir() {
+			x.Add(prefix)
+			return prefix, nil
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", ErrImageNotFound
+	case 1:
+		return matches[0], nil
+	}
+
+	// a complete id is never ambiguous even if it prefixes another one
+	if matches[0] == prefix {
+		return prefix, nil
+	}
+
+	if len(matches) > maxCandidates {
+		matches = matches[:maxCandidates]
+	}
+	return "", &AmbiguousImageError{Prefix: prefix, Candidates: matches}
+}
+
+func (x *ImageIndex) lookup(prefix string) (matches []string) {
+	x.RLock()
+	defer x.RUnlock()
+	for i := sort.SearchStrings(x.ids, prefix); i < len(x.ids); i++ {
+		if !strings.HasPrefix(x.ids[i], prefix) || len(matches) > maxCandidates {
+			break
+		}
+		matches = append(matches, x.ids[i])
+	}
+	return
+}
+
+// present drops the ids whose images have been removed by another process,
+// like the gc command, from ids and the index.
+func (x *ImageIndex) present(ids []string) (found []string) {
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(x.Dir, id)); os.IsNotExist(err) {
+			x.Remove(id)
+			continue
+		}
+		found = append(found, id)
+	}
+	return
+}
+
+func validImageId(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// walkTempFiles calls fn for each temporary file under images/ and
+// repositories/, whether it belongs to a write in progress or was left
+// behind by one which never finished. Older releases named them by adding
+// .tmp, which is only recognised under images/ as a tag may end that way.
+func (s *Store) walkTempFiles(fn func(path string, info os.FileInfo)) {
+	for _, dir := range []string{s.ImagesDir(), filepath.Join(s.Dir, "repositories")} {
+		legacy := dir == s.ImagesDir()
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if isTempFile(info.Name()) || (legacy && strings.HasSuffix(info.Name(), ".tmp")) {
+				fn(path, info)
+			}
+			return nil
+		})
+	}
+}
+
+// Janitor removes temporary files which have outlived any write that could
+// still be using them, such as those left by a crash.
+type Janitor struct {
+	Store    *Store
+	Interval time.Duration
+	MaxAge   time.Duration
+	stop     chan struct{}
+}
+
+func NewJanitor(store *Store, interval, maxAge time.Duration) *Janitor {
+	return &Janitor{Store: store, Interval: interval, MaxAge: maxAge, stop: make(chan struct{})}
+}
+
+// Start sweeps straight away and then every Interval.
+func (j *Janitor) Start() {
+	go func() {
+		for {
+			j.Sweep()
+			select {
+			case <-time.After(j.Interval):
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (j *Janitor) Stop() {
+	close(j.stop)
+}
+
+// Sweep removes temporary files last modified longer than MaxAge ago,
+// returning how many went and the bytes they took up.
+func (j *Janitor) Sweep() (removed int, freed int64) {
+	cutoff := time.Now().Add(-j.MaxAge)
+	j.Store.walkTempFiles(func(path string, info os.FileInfo) {
+		if info.ModTime().After(cutoff) {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		logger.Infof("removed orphaned %s of %d bytes", path, info.Size())
+		removed++
+		freed += info.Size()
+	})
+
+	metrics.Add("janitor_tmp_removed", int64(removed))
+	metrics.Add("janitor_bytes_reclaimed", freed)
+	logger.Infof("janitor removed %d temporary files reclaiming %d bytes", removed, freed)
+	return
+}
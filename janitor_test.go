@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (t *testSuite) TestJanitorSweep() {
+	store := &Store{resetTmpDataDir()}
+	repo := store.Repository("dynport/test")
+	old := store.Image("abc").Dir + "/.layer.123.tmp"
+	legacy := store.Image("abc").Dir + "/json.tmp"
+	recent := repo.Dir + "/tags/.latest.456.tmp"
+
+	for _, path := range []string{old, legacy, recent} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		t.Nil(ioutil.WriteFile(path, []byte("12345"), 0644))
+	}
+	// a tag named like a temporary file of older releases is kept
+	t.Nil(repo.SetTag("v1.tmp", []byte(`"abc"`), &TagHistoryEntry{}))
+
+	stale := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{old, legacy, repo.TagPath("v1.tmp")} {
+		t.Nil(os.Chtimes(path, stale, stale))
+	}
+
+	removed, freed := NewJanitor(store, time.Hour, time.Hour).Sweep()
+	t.Equal(2, removed)
+	t.Equal(int64(10), freed)
+
+	for _, path := range []string{old, legacy} {
+		_, err := os.Stat(path)
+		t.True(os.IsNotExist(err))
+	}
+	_, err := os.Stat(recent)
+	t.Nil(err)
+	t.Equal("abc", repo.Tags()["v1.tmp"])
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func (t *testSuite) TestUploadLimits() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	h.UploadLimits = UploadLimits{Json: 64, Tag: 8, Layer: 10}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	put := func(path string, body io.Reader) int {
+		req, _ := http.NewRequest("PUT", ser.URL+path, body)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(413, put("/v1/images/abc/layer", bytes.NewReader([]byte("12345678901"))))
+	t.Equal(200, put("/v1/images/abc/layer", bytes.NewReader([]byte("1234567890"))))
+	t.Equal(413, put("/v1/images/def/json", bytes.NewReader(bytes.Repeat([]byte(" "), 65))))
+	t.Equal(413, put("/v1/repositories/dynport/test/tags/latest", bytes.NewReader([]byte(`"abcdefgh"`))))
+
+	// without a Content-Length the copy stops at the limit
+	t.Equal(413, put("/v1/images/def/layer", io.MultiReader(strings.NewReader("123456"), strings.NewReader("789012"))))
+	_, err := os.Stat(h.DataDir + "/images/def/layer")
+	t.True(os.IsNotExist(err))
+	leftover, _ := filepath.Glob(h.DataDir + "/images/def/.*.tmp")
+	t.Equal(0, len(leftover))
+}
+
+func (t *testSuite) TestUploadLimitExpectContinue() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	h.UploadLimits.Layer = 10
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ser.URL, "http://"))
+	t.Nil(err)
+	defer conn.Close()
+
+	// the body is never sent, the rejection has to come first
+	fmt.Fprintf(conn, "PUT /v1/images/abc/layer HTTP/1.1\r\nHost: registry\r\nContent-Length: 1000\r\nExpect: 100-continue\r\n\r\n")
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	t.Nil(err)
+	t.Equal(413, rsp.StatusCode)
+}
@@ -4,9 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/wolfeidau/docker-registry/conf"
@@ -43,7 +44,7 @@ func createPidFile(pidFile string) error {
 
 func removePidFile(pidFile string) {
 	if err := os.Remove(pidFile); err != nil {
-		logger.Error("Error removing %s: %s", pidFile, err)
+		logger.Errorf("Error removing %s: %s", pidFile, err)
 	}
 }
 
@@ -52,11 +53,172 @@ func startServer(config *conf.Configuration) {
 	logger.Info("starting server on ", config.Listen)
 	logger.Info("using dataDir ", config.Data)
 
-	users := NewSingleUserStore(config.Pass)
+	moved, err := (&Store{config.Data}).MigrateRepositories(config.Namespace)
+	for _, name := range moved {
+		logger.Infof("moved repository %s under its namespace", name)
+	}
+	if err != nil {
+		logger.Errorf("migrating repositories: %s", err)
+	}
+
+	var users UserStore
+	switch config.UserStore {
+	case "single":
+		users = NewSingleUserStore(config.Pass)
+	case "file":
+		users = (&Store{config.Data}).Users()
+	default:
+		logger.Errorf("unknown user store %s", config.UserStore)
+		return
+	}
+
+	if config.Registration != "open" && config.Registration != "closed" {
+		logger.Errorf("registration should be open or closed, not %s", config.Registration)
+		return
+	}
+
+	var sessions SessionStore
+	switch config.SessionStore {
+	case "memory":
+		memory := NewMemorySessionStore()
+		memory.EvictEvery(time.Minute)
+		sessions = memory
+	case "redis":
+		logger.Info("using redis ", config.Redis)
+		sessions = NewRedisSessionStore(config.Redis)
+	default:
+		logger.Errorf("unknown session store %s", config.SessionStore)
+		return
+	}
 
 	auth := NewBasicAuth(users, config.Secret)
+	auth.Sessions = sessions
+
+	if auth.TTL, err = time.ParseDuration(config.SessionTTL); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if auth.MaxSessions, err = strconv.Atoi(config.MaxSessions); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	limits, err := ParseRateLimits(config.RateLimits)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	quotas, err := ParseQuotas(config.Quotas)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	if config.ScrubInterval != "" {
+		interval, err := time.ParseDuration(config.ScrubInterval)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		rate, err := parseSize(config.ScrubRate)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		NewScrubber(&Store{config.Data}, interval, rate).Start()
+	}
+
+	tmpMaxAge, err := time.ParseDuration(config.TmpMaxAge)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	tmpSweepInterval, err := time.ParseDuration(config.TmpSweepInterval)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	NewJanitor(&Store{config.Data}, tmpSweepInterval, tmpMaxAge).Start()
+
+	var policies []*RetentionPolicy
+	if config.Retention != "" {
+		if policies, err = LoadRetentionPolicies(config.Retention); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+
+	trash, err := time.ParseDuration(config.TrashRetention)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	pushTimeout, err := time.ParseDuration(config.PushTimeout)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
 
-	if err := http.ListenAndServe(config.Listen, NewHandler(config.Data, config.Namespace, auth)); err != nil {
+	uploadLimits := UploadLimits{}
+	if uploadLimits.Json, err = parseSize(config.MaxJsonSize); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if uploadLimits.Tag, err = parseSize(config.MaxTagSize); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if uploadLimits.Layer, err = parseSize(config.MaxLayerSize); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	timeouts := ServerTimeouts{}
+	if timeouts.Header, err = time.ParseDuration(config.HeaderTimeout); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if timeouts.Idle, err = time.ParseDuration(config.IdleTimeout); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if timeouts.Chunk, err = time.ParseDuration(config.ChunkTimeout); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	handler := NewHandler(config.Data, config.Namespace, auth)
+	handler.Quotas.Limits = quotas
+	handler.Cache = sessions
+	handler.OpenRegistration = config.Registration == "open"
+	handler.Retention = policies
+	handler.TrashRetention = trash
+	handler.UploadLimits = uploadLimits
+	handler.ChunkTimeout = timeouts.Chunk
+	handler.Pushes.Timeout = pushTimeout
+	handler.Pushes.ExpireEvery(time.Minute)
+	if config.Admins != "" {
+		handler.Admins = strings.Split(config.Admins, ",")
+	} else if _, ok := users.(WritableUserStore); ok {
+		logger.Warn("no REGISTRY_ADMINS listed, nobody can use the admin api")
+	}
+
+	if config.RetentionInterval != "" {
+		interval, err := time.ParseDuration(config.RetentionInterval)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		job := NewRetentionJob(&Store{config.Data}, policies, interval, trash)
+		job.Images = handler.Images
+		job.Quotas = handler.Quotas
+		job.Start()
+	}
+
+	server := NewServer(config.Listen, NewRateLimiter(handler, limits), timeouts)
+	if err := server.ListenAndServe(); err != nil {
 		logger.Error(err.Error())
 	}
 }
@@ -65,6 +227,10 @@ func main() {
 
 	version := flag.Bool("version", false, "prints current docker-registry version")
 
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, commandUsage())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if *version {
@@ -83,5 +249,18 @@ func main() {
 	if conf.Debug {
 		logger.Level = logrus.DebugLevel
 	}
+
+	// anything left after the flags is a maintenance command
+	if flag.NArg() > 0 {
+		if !conf.Debug {
+			logger.Level = logrus.WarnLevel
+		}
+		if err := runCommand(&Store{conf.Data}, os.Stdout, flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	startServer(conf)
 }
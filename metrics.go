@@ -0,0 +1,14 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// metrics are published through expvar and served to admins from
+// /v1/_admin/metrics.
+var metrics = expvar.NewMap("registry")
+
+func (h *Handler) GetMetrics(w http.ResponseWriter, r *http.Request, p [][]string) {
+	expvar.Handler().ServeHTTP(w, r)
+}
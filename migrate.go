@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// isLegacyRepository is true for a repository kept directly under
+// repositories/ as older releases did, rather than under its namespace. Such
+// a directory has the repository's image list or index in it, where a
+// namespace only holds directories.
+func isLegacyRepository(dir string) bool {
+	for _, name := range []string{"images", "_index"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.Mode().IsRegular() {
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateRepositories moves repositories kept as repositories/<repo> by
+// older releases to repositories/<namespace>/<repo>, returning the names
+// moved. A repository which already exists under the namespace is left where
+// it is and reported as an error once the rest have moved, as is a legacy
+// repository named like the namespace, which nothing is moved into.
+func (s *Store) MigrateRepositories(namespace string) (moved []string, err error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("a namespace is needed to migrate repositories")
+	}
+
+	names, err := readDirNames(filepath.Join(s.Dir, "repositories"))
+	if err != nil {
+		return nil, err
+	}
+
+	if isLegacyRepository(filepath.Join(s.Dir, "repositories", namespace)) {
+		return nil, fmt.Errorf("repository %s is in the way of namespace %s, move it by hand", namespace, namespace)
+	}
+
+	var conflicts []string
+	for _, name := range names {
+		dir := filepath.Join(s.Dir, "repositories", name)
+		if !isLegacyRepository(dir) {
+			continue
+		}
+
+		target := s.Repository(namespace + "/" + name)
+		if _, err := os.Stat(target.Dir); err == nil {
+			conflicts = append(conflicts, name)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target.Dir), 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(dir, target.Dir); err != nil {
+			return moved, err
+		}
+		moved = append(moved, namespace+"/"+name)
+	}
+
+	if len(conflicts) > 0 {
+		return moved, fmt.Errorf("repositories %v also exist under %s, move them by hand", conflicts, namespace)
+	}
+	return moved, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+func (t *testSuite) TestMigrateRepositories() {
+	store := &Store{copyFixtures()}
+	repos := filepath.Join(store.Dir, "repositories")
+
+	// lay the fixture out as older releases did, without the namespace
+	t.Nil(os.Rename(filepath.Join(repos, "dynport/redis"), filepath.Join(repos, "redis")))
+	t.Nil(os.Remove(filepath.Join(repos, "dynport")))
+	t.Nil(os.MkdirAll(filepath.Join(repos, "other/busybox/tags"), 0755))
+
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(store, out, []string{"repos", "migrate", "dynport"}))
+	t.Equal("moved dynport/redis\n", out.String())
+	t.Equal(1, len(store.Repository("dynport/redis").Tags()))
+
+	names, _ := store.Repositories()
+	t.Equal([]string{"dynport/redis", "other/busybox"}, names)
+
+	// running again has nothing to do
+	moved, err := store.MigrateRepositories("dynport")
+	t.Nil(err)
+	t.Equal(0, len(moved))
+
+	// a namespace holding a repository called tags isn't a repository
+	tags := store.Repository("other/tags")
+	t.Nil(os.MkdirAll(tags.Dir, 0755))
+	t.Nil(writeFile(tags.ImagesPath(), nopCloser([]byte(`[]`))))
+	moved, err = store.MigrateRepositories("dynport")
+	t.Nil(err)
+	t.Equal(0, len(moved))
+
+	// a repository under the namespace already is never overwritten
+	t.Nil(os.MkdirAll(filepath.Join(repos, "redis/tags"), 0755))
+	t.Nil(writeFile(filepath.Join(repos, "redis/images"), nopCloser([]byte(`[]`))))
+	_, err = store.MigrateRepositories("dynport")
+	t.True(err != nil)
+	t.Equal(1, len(store.Repository("dynport/redis").Tags()))
+	_, err = os.Stat(filepath.Join(repos, "redis/images"))
+	t.Nil(err)
+}
+
+func (t *testSuite) TestMigrateRepositoryNamedLikeNamespace() {
+	store := &Store{resetTmpDataDir()}
+	legacy := filepath.Join(store.Dir, "repositories", "library")
+	t.Nil(os.MkdirAll(legacy, 0755))
+	t.Nil(writeFile(filepath.Join(legacy, "images"), nopCloser([]byte(`[]`))))
+
+	moved, err := store.MigrateRepositories("library")
+	t.True(err != nil)
+	t.Equal(0, len(moved))
+	_, err = os.Stat(filepath.Join(legacy, "images"))
+	t.Nil(err)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+)
+
+const (
+	// the tag can't be moved once written, nor deleted
+	ProtectImmutable = "immutable"
+	// only admins may write or delete the tag
+	ProtectAdminOnly = "admin-only"
+	// the tag can be moved but not deleted
+	ProtectDenyDelete = "deny-delete"
+)
+
+// ProtectionRule applies a protection mode to the tags matching a glob.
+type ProtectionRule struct {
+	Pattern string `json:"pattern"`
+	Mode    string `json:"mode"`
+}
+
+func (rule *ProtectionRule) Validate() error {
+	switch rule.Mode {
+	case ProtectImmutable, ProtectAdminOnly, ProtectDenyDelete:
+	default:
+		return fmt.Errorf("unknown protection mode %q", rule.Mode)
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+		return fmt.Errorf("invalid tag pattern %q", rule.Pattern)
+	}
+	return nil
+}
+
+type ProtectionError struct {
+	Status          int
+	Tag, Mode, Rule string
+	Action          string
+}
+
+func (e *ProtectionError) Error() string {
+	return fmt.Sprintf("tag %s is %s by rule %s and can't be %s", e.Tag, e.Mode, e.Rule, e.Action)
+}
+
+func (r *Repository) ProtectionPath() string {
+	return r.Dir + "/_protection"
+}
+
+func (r *Repository) ProtectionRules() ([]*ProtectionRule, error) {
+	rules := []*ProtectionRule{}
+
+	data, err := ioutil.ReadFile(r.ProtectionPath())
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rules, json.Unmarshal(data, &rules)
+}
+
+func (r *Repository) WriteProtectionRules(rules []*ProtectionRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return writeFile(r.ProtectionPath(), nopCloser(data))
+}
+
+// CheckTagWrite returns a ProtectionError when the rules forbid pointing tag
+// at the image id, rewriting a tag with the image it already has is allowed.
+func (r *Repository) CheckTagWrite(tag, id string, admin bool) error {
+	current, exists := r.Tags()[tag]
+
+	return r.checkTag(tag, func(rule *ProtectionRule) error {
+		switch {
+		case rule.Mode == ProtectImmutable && exists && current != id:
+			return &ProtectionError{http.StatusConflict, tag, "immutable", rule.Pattern, "overwritten"}
+		case rule.Mode == ProtectAdminOnly && !admin:
+			return &ProtectionError{http.StatusForbidden, tag, "admin-only", rule.Pattern, "written"}
+		}
+		return nil
+	})
+}
+
+// CheckTagDelete returns a ProtectionError when the rules forbid deleting tag.
+func (r *Repository) CheckTagDelete(tag string, admin bool) error {
+	return r.checkTag(tag, func(rule *ProtectionRule) error {
+		switch {
+		case rule.Mode == ProtectImmutable:
+			return &ProtectionError{http.StatusConflict, tag, "immutable", rule.Pattern, "deleted"}
+		case rule.Mode == ProtectDenyDelete:
+			return &ProtectionError{http.StatusForbidden, tag, "protected", rule.Pattern, "deleted"}
+		case rule.Mode == ProtectAdminOnly && !admin:
+			return &ProtectionError{http.StatusForbidden, tag, "admin-only", rule.Pattern, "deleted"}
+		}
+		return nil
+	})
+}
+
+func (r *Repository) checkTag(tag string, check func(rule *ProtectionRule) error) error {
+	rules, err := r.ProtectionRules()
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.Pattern, tag); matched {
+			if err := check(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
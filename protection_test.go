@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+func (t *testSuite) TestProtectedTags() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	h.Admins = []string{"admin"}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path, login, body string) int {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		if login != "" {
+			req.SetBasicAuth(login, "pass")
+		}
+		rsp, _ := http.DefaultClient.Do(req)
+		return rsp.StatusCode
+	}
+
+	rules := `[{"pattern":"v*","mode":"immutable"},{"pattern":"latest","mode":"deny-delete"},{"pattern":"prod","mode":"admin-only"}]`
+	t.Equal(403, do("PUT", "/v1/repositories/dynport/redis/_protection", "mark", rules))
+	t.Equal(400, do("PUT", "/v1/repositories/dynport/redis/_protection", "admin", `[{"pattern":"v*","mode":"sticky"}]`))
+	t.Equal(204, do("PUT", "/v1/repositories/dynport/redis/_protection", "admin", rules))
+
+	first := `"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c"`
+	second := `"0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8"`
+
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/v1.0.0", "mark", first))
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/v1.0.0", "mark", first))
+	t.Equal(409, do("PUT", "/v1/repositories/dynport/redis/tags/v1.0.0", "mark", second))
+	t.Equal(409, do("DELETE", "/v1/repositories/dynport/redis/tags/v1.0.0", "admin", ""))
+
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/latest", "mark", second))
+	t.Equal(403, do("DELETE", "/v1/repositories/dynport/redis/tags/latest", "mark", ""))
+
+	t.Equal(403, do("PUT", "/v1/repositories/dynport/redis/tags/prod", "mark", first))
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/prod", "admin", first))
+	t.Equal(403, do("DELETE", "/v1/repositories/dynport/redis/tags/prod", "", ""))
+	t.Equal(200, do("DELETE", "/v1/repositories/dynport/redis/tags/prod", "admin", ""))
+	t.Equal(404, do("DELETE", "/v1/repositories/dynport/redis/tags/prod", "admin", ""))
+
+	// rolling back is a write like any other
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/prod", "admin", first))
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/redis/tags/prod", "admin", second))
+	t.Equal(403, do("POST", "/v1/repositories/dynport/redis/tags/prod/_rollback", "mark", ""))
+	t.Equal(200, do("POST", "/v1/repositories/dynport/redis/tags/prod/_rollback", "admin", ""))
+}
+
+func (t *testSuite) TestImmutableTagConcurrentWrites() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+	t.Nil(repo.WriteProtectionRules([]*ProtectionRule{{Pattern: "v*", Mode: ProtectImmutable}}))
+
+	ids := []string{
+		"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c",
+		"0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8",
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			errs <- repo.WriteTag("v1", []byte(`"`+id+`"`), &TagHistoryEntry{}, false)
+		}(ids[i%2])
+	}
+	wg.Wait()
+	close(errs)
+
+	// only writes of whichever image got there first succeed
+	written := repo.Tags()["v1"]
+	history, _ := repo.TagHistory("v1")
+	for _, entry := range history {
+		t.Equal(written, entry.ImageId)
+	}
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	t.Equal(10, failed)
+}
+
+func (t *testSuite) TestProtectionChangedDuringDelete() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+
+	// a rule change in progress holds the rules
+	unlock := lockPath(repo.ProtectionPath())
+	errs := make(chan error)
+	go func() {
+		_, err := store.TrashTag("dynport/redis", "latest", &TagHistoryEntry{}, true)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tmpName, _, err := writeTemp(repo.ProtectionPath(), nopCloser([]byte(`[{"pattern":"latest","mode":"deny-delete"}]`)))
+	t.Nil(err)
+	t.Nil(commitTemp(tmpName, repo.ProtectionPath()))
+	unlock()
+
+	_, protected := (<-errs).(*ProtectionError)
+	t.True(protected)
+	_, ok := repo.Tags()["latest"]
+	t.True(ok)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wolfeidau/docker-registry/uuid"
+)
+
+// how long a push may go without any upload before it is rolled back
+const pushTimeout = 24 * time.Hour
+
+// IncompletePushError lists the images a push refers to which are missing
+// their json or layer.
+type IncompletePushError struct {
+	Missing []string
+}
+
+func (e *IncompletePushError) Error() string {
+	return fmt.Sprintf("push is missing images %s", strings.Join(e.Missing, ", "))
+}
+
+type stagedTag struct {
+	tag   string
+	value []byte
+	entry *TagHistoryEntry
+	admin bool
+}
+
+type push struct {
+	repo    string
+	dir     string
+	index   []byte
+	tags    []*stagedTag
+	charged int64
+	touched time.Time
+}
+
+// Pushes tracks the push each session token is making. Images and tags
+// uploaded during a push are staged under Dir and only moved into the store
+// once the image list is put and everything it refers to has arrived.
+type Pushes struct {
+	sync.Mutex
+	Dir       string
+	Timeout   time.Duration
+	Quotas    *Quotas
+	Namespace string
+	pushes    map[string]*push
+}
+
+func NewPushes(dir string) *Pushes {
+	return &Pushes{Dir: dir, Timeout: pushTimeout, pushes: make(map[string]*push)}
+}
+
+// Start begins staging a push to repo, starting again with the same token
+// and repository carries on the push already staged.
+func (p *Pushes) Start(token, repo string, index []byte) error {
+	p.Expire()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if existing, ok := p.pushes[token]; ok {
+		if existing.repo == repo {
+			existing.index = index
+			existing.touched = time.Now()
+			return nil
+		}
+		p.rollback(existing)
+	}
+
+	dir := filepath.Join(p.Dir, uuid.NewUUID())
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		return err
+	}
+	p.pushes[token] = &push{repo: repo, dir: dir, index: index, touched: time.Now()}
+	return nil
+}
+
+func (p *Pushes) Repository(token string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if push, ok := p.pushes[token]; ok {
+		return push.repo, true
+	}
+	return "", false
+}
+
+// ImageDir returns where to stage an image uploaded with token, if it is
+// part of a push.
+func (p *Pushes) ImageDir(token, id string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if push, ok := p.pushes[token]; ok {
+		push.touched = time.Now()
+		return filepath.Join(push.dir, "images", id), true
+	}
+	return "", false
+}
+
+// Charge records the layer bytes a push has reserved against its
+// repository's quota, so they can be settled when it is committed or given
+// back when it is rolled back. It is false once the push has gone.
+func (p *Pushes) Charge(token string, size int64) bool {
+	p.Lock()
+	defer p.Unlock()
+	if push, ok := p.pushes[token]; ok {
+		push.charged += size
+		return true
+	}
+	return false
+}
+
+// StageTag holds back a tag of the repository being pushed until the push
+// is committed, returning false when token isn't pushing to repo.
+func (p *Pushes) StageTag(token, repo, tag string, value []byte, entry *TagHistoryEntry, admin bool) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	push, ok := p.pushes[token]
+	if !ok || push.repo != repo {
+		return false
+	}
+	entry.Timestamp = time.Now()
+	push.tags = append(push.tags, &stagedTag{tag, value, entry, admin})
+	push.touched = entry.Timestamp
+	return true
+}
+
+// Commit finishes the push made with token to repo, moving its staged images
+// into the store and writing the image list and tags, provided every image
+// they refer to is complete. It returns the ids of the images added. A
+// commit which fails part way leaves what it has moved into the store there
+// and the push in place, so committing again carries on where it stopped.
+func (p *Pushes) Commit(token string, store *Store, repo string, images []byte) (added []string, ok bool, err error) {
+	p.Lock()
+	push, ok := p.pushes[token]
+	if !ok || push.repo != repo {
+		p.Unlock()
+		return nil, false, nil
+	}
+	// no other request can use the push while it is committed
+	delete(p.pushes, token)
+	p.Unlock()
+
+	defer func() {
+		if err != nil {
+			p.Lock()
+			push.touched = time.Now()
+			p.pushes[token] = push
+			p.Unlock()
+		}
+	}()
+
+	if err = p.verify(push, store, images); err != nil {
+		return nil, true, err
+	}
+
+	r := store.Repository(p.Namespace + "/" + repo)
+
+	// neither the tags nor their protection can change from the check until
+	// the tags are written
+	names := []string{}
+	for _, tag := range push.tags {
+		names = append(names, tag.tag)
+	}
+	unlock := r.lockTags(names)
+	defer unlock()
+
+	for _, tag := range push.tags {
+		if err = r.CheckTagWrite(tag.tag, tagImageId(tag.value), tag.admin); err != nil {
+			return nil, true, err
+		}
+	}
+
+	staged, err := readDirNames(filepath.Join(push.dir, "images"))
+	if err != nil {
+		return nil, true, err
+	}
+
+	commit := func() error {
+		for _, id := range staged {
+			if err := p.commitImage(push, store.Image(id)); err != nil {
+				return err
+			}
+			added = append(added, id)
+		}
+		if push.index != nil {
+			if err := writeFile(r.IndexPath(), nopCloser(push.index)); err != nil {
+				return err
+			}
+		}
+		return writeFile(r.ImagesPath(), nopCloser(images))
+	}
+	if p.Quotas != nil {
+		err = p.Quotas.Commit(p.Namespace, push.repo, push.charged, commit)
+	} else {
+		err = commit()
+	}
+	if err != nil {
+		return added, true, err
+	}
+	// the layers are stored, there is nothing left to release
+	push.charged = 0
+
+	for len(push.tags) > 0 {
+		tag := push.tags[0]
+		if err = r.setTag(tag.tag, tag.value, tag.entry); err != nil {
+			return added, true, err
+		}
+		// committing again after a failure only writes the tags left
+		push.tags = push.tags[1:]
+	}
+
+	os.RemoveAll(push.dir)
+	return added, true, nil
+}
+
+// commitImage moves a staged image into the store, the first push to
+// complete an image wins.
+func (p *Pushes) commitImage(push *push, image *Image) error {
+	unlock := lockPath(image.Dir)
+	defer unlock()
+
+	if _, err := os.Stat(image.Dir); err == nil {
+		return nil
+	}
+	if err := moveFile(filepath.Join(push.dir, "images", image.Id()), image.Dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(image.Dir))
+}
+
+// verify checks every image listed, tagged or an ancestor of one has both
+// its json and layer, either staged or already in the store.
+func (p *Pushes) verify(push *push, store *Store, images []byte) error {
+	listed := []*RepositoryImage{}
+	if err := json.Unmarshal(images, &listed); err != nil {
+		return fmt.Errorf("invalid image list: %s", err)
+	}
+
+	ids := []string{}
+	for _, image := range listed {
+		ids = append(ids, image.Id)
+	}
+	for _, tag := range push.tags {
+		ids = append(ids, tagImageId(tag.value))
+	}
+
+	missing := []string{}
+	checked := make(map[string]bool)
+	for _, id := range ids {
+		for id != "" && !checked[id] {
+			checked[id] = true
+
+			image := &Image{filepath.Join(push.dir, "images", id)}
+			if _, err := os.Stat(image.Dir); err != nil {
+				image = store.Image(id)
+			}
+
+			atts, err := image.Header()
+			_, layerErr := os.Stat(image.LayerPath())
+			if err != nil || layerErr != nil {
+				missing = append(missing, id)
+				break
+			}
+			id = atts.Parent
+		}
+	}
+
+	if len(missing) > 0 {
+		return &IncompletePushError{missing}
+	}
+	return nil
+}
+
+// Expire rolls back pushes which have gone quiet for longer than Timeout,
+// along with staging left behind by a previous run of the registry.
+func (p *Pushes) Expire() {
+	p.Lock()
+	defer p.Unlock()
+
+	cutoff := time.Now().Add(-p.Timeout)
+	active := make(map[string]bool)
+	for token, push := range p.pushes {
+		if push.touched.Before(cutoff) {
+			logger.Infof("rolling back abandoned push to %s", push.repo)
+			p.rollback(push)
+			delete(p.pushes, token)
+			continue
+		}
+		active[filepath.Base(push.dir)] = true
+	}
+
+	dirs, _ := readDirNames(p.Dir)
+	for _, dir := range dirs {
+		info, err := os.Stat(filepath.Join(p.Dir, dir))
+		if err == nil && !active[dir] && info.ModTime().Before(cutoff) {
+			os.RemoveAll(filepath.Join(p.Dir, dir))
+		}
+	}
+}
+
+// ExpireEvery rolls back abandoned pushes in the background.
+func (p *Pushes) ExpireEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			p.Expire()
+		}
+	}()
+}
+
+func (p *Pushes) rollback(push *push) {
+	if err := os.RemoveAll(push.dir); err != nil {
+		logger.Error(err.Error())
+	}
+	if p.Quotas != nil {
+		p.Quotas.Release(p.Namespace, push.repo, push.charged)
+	}
+}
+
+// requestToken returns the session token of the request, either presented by
+// the client or just issued to it by RepoAuthenticator.
+func requestToken(w http.ResponseWriter, r *http.Request) string {
+	if token := w.Header().Get("X-Docker-Token"); token != "" {
+		return token
+	}
+
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) == 2 && s[0] == "Token" {
+		return s[1]
+	}
+	return ""
+}
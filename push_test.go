@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+func (t *testSuite) TestAtomicPush() {
+	h := NewHandler(resetTmpDataDir(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/test/", bytes.NewReader([]byte(`[{"id":"child"}]`)))
+	req.SetBasicAuth("user", "pass")
+	rsp, _ := http.DefaultClient.Do(req)
+	t.Equal(200, rsp.StatusCode)
+	token := rsp.Header.Get("X-Docker-Token")
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Token "+token)
+		rsp, _ := http.DefaultClient.Do(req)
+		return rsp
+	}
+
+	t.Equal(200, do("PUT", "/v1/images/child/json", `{"id":"child","parent":"base"}`).StatusCode)
+	t.Equal(200, do("PUT", "/v1/images/child/layer", "child layer").StatusCode)
+	t.Equal(200, do("PUT", "/v1/repositories/dynport/test/tags/latest", `"child"`).StatusCode)
+
+	// nothing is visible until the push completes
+	t.Equal(404, do("GET", "/v1/images/child/json", "").StatusCode)
+	repo := h.repository("test")
+	t.Equal(0, len(repo.Tags()))
+	_, err := os.Stat(repo.IndexPath())
+	t.True(os.IsNotExist(err))
+
+	rsp = do("PUT", "/v1/repositories/dynport/test/images", `[{"id":"child"}]`)
+	t.Equal(400, rsp.StatusCode)
+	apiErr := &ApiError{}
+	json.NewDecoder(rsp.Body).Decode(apiErr)
+	t.Equal(CodePushIncomplete, apiErr.Code)
+	t.Equal([]interface{}{"base"}, apiErr.Detail.(map[string]interface{})["missing"])
+	t.Equal(0, len(repo.Tags()))
+
+	t.Equal(200, do("PUT", "/v1/images/base/json", `{"id":"base"}`).StatusCode)
+	t.Equal(200, do("PUT", "/v1/images/base/layer", "base layer").StatusCode)
+	t.Equal(204, do("PUT", "/v1/repositories/dynport/test/images", `[{"id":"child"}]`).StatusCode)
+
+	t.Equal(200, do("GET", "/v1/images/child/json", "").StatusCode)
+	t.Equal("child", repo.Tags()["latest"])
+	images, _ := repo.Images()
+	t.Equal(`[{"id":"child"}]`, string(images))
+	staged, _ := readDirNames(h.Pushes.Dir)
+	t.Equal(0, len(staged))
+}
+
+func (t *testSuite) TestAbandonedPush() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	t.Nil(h.Pushes.Start("token", "test", []byte("[]")))
+
+	dir, ok := h.Pushes.ImageDir("token", "abc")
+	t.True(ok)
+	image := &Image{dir}
+	t.Nil(image.WriteLayer(nopCloser([]byte("12345"))))
+	t.Nil(h.Quotas.Reserve("dynport", "test", 5))
+	h.Pushes.Charge("token", 5)
+
+	h.Pushes.Expire()
+	_, ok = h.Pushes.Repository("token")
+	t.True(ok)
+
+	h.Pushes.Timeout = 0
+	h.Pushes.Expire()
+	_, ok = h.Pushes.Repository("token")
+	t.False(ok)
+
+	staged, _ := readDirNames(h.Pushes.Dir)
+	t.Equal(0, len(staged))
+	t.Equal(int64(0), h.Quotas.Usage()["dynport/test"].Used)
+}
+
+func (t *testSuite) TestPushCommitRetried() {
+	store := &Store{resetTmpDataDir()}
+	pushes := NewPushes(store.Dir + "/_staging")
+	pushes.Namespace = "dynport"
+	t.Nil(pushes.Start("token", "test", []byte("[]")))
+
+	for _, id := range []string{"base", "child"} {
+		dir, _ := pushes.ImageDir("token", id)
+		image := &Image{dir}
+		t.Nil(writeFile(dir+"/json", nopCloser([]byte(`{"id":"`+id+`"}`))))
+		t.Nil(image.WriteLayer(nopCloser([]byte(id))))
+	}
+	t.True(pushes.StageTag("token", "test", "latest", []byte(`"child"`), &TagHistoryEntry{User: "mark"}, false))
+	t.True(pushes.StageTag("token", "test", "stable", []byte(`"base"`), &TagHistoryEntry{User: "mark"}, false))
+
+	// a directory where the tag goes makes writing it fail
+	repo := store.Repository("dynport/test")
+	t.Nil(os.MkdirAll(repo.TagPath("stable")+"/blocked", 0755))
+
+	added, ok, err := pushes.Commit("token", store, "test", []byte(`[{"id":"child"}]`))
+	t.True(ok)
+	t.True(err != nil)
+	t.Equal(2, len(added))
+	t.Equal("child", repo.Tags()["latest"])
+
+	t.Nil(os.RemoveAll(repo.TagPath("stable")))
+	added, ok, err = pushes.Commit("token", store, "test", []byte(`[{"id":"child"}]`))
+	t.True(ok)
+	t.Nil(err)
+	t.Equal(0, len(added))
+	t.Equal("base", repo.Tags()["stable"])
+
+	// tags written before the failure aren't written again
+	history, _ := repo.TagHistory("latest")
+	t.Equal(1, len(history))
+	_, ok = pushes.Repository("token")
+	t.False(ok)
+}
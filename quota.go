@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type QuotaExceededError struct {
+	Scope       string
+	Used, Limit int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s, %d of %d bytes used", e.Scope, e.Used, e.Limit)
+}
+
+type QuotaUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// ParseQuotas reads limits in the form dynport=10G,dynport/redis=2G, keyed
+// by namespace or namespace/repository.
+func ParseQuotas(spec string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pair := strings.SplitN(entry, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid quota %q", entry)
+		}
+
+		size, err := parseSize(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(pair[0])] = size
+	}
+
+	return limits, nil
+}
+
+// Quotas tracks the bytes of layers stored per namespace and per repository.
+// Usage is counted from disk by Scan, which runs again whenever something is
+// deleted, and uploads reserve their bytes as they arrive so concurrent
+// uploads can't go over a limit together. Reserved bytes which Scan can't
+// see yet, still arriving or staged by a push, are pending and carried
+// across scans until they are committed or released.
+type Quotas struct {
+	sync.Mutex
+	Limits map[string]int64
+	// Namespace is charged for the images no repository lists, such as
+	// layers uploaded outside a push.
+	Namespace string
+	dataDir   string
+	usage     map[string]int64
+	pending   map[string]int64
+	// scanning keeps Commit from storing and settling bytes while Scan walks
+	// the store, so a scan counts them either on disk or as pending, never
+	// both or neither.
+	scanning sync.RWMutex
+}
+
+func NewQuotas(dataDir, namespace string, limits map[string]int64) *Quotas {
+	quotas := &Quotas{Limits: limits, Namespace: namespace, dataDir: dataDir, pending: make(map[string]int64)}
+	if err := quotas.Scan(dataDir); err != nil {
+		logger.Error(err.Error())
+	}
+	return quotas
+}
+
+// Scan recomputes usage from the repositories under dataDir, a layer counts
+// once towards each repository listing it and once towards its namespace.
+func (q *Quotas) Scan(dataDir string) error {
+	q.scanning.Lock()
+	defer q.scanning.Unlock()
+
+	usage := make(map[string]int64)
+	listed := make(map[string]bool)
+
+	namespaces, err := ioutil.ReadDir(dataDir + "/repositories")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, namespace := range namespaces {
+		seen := make(map[string]bool)
+
+		repos, err := ioutil.ReadDir(filepath.Join(dataDir, "repositories", namespace.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, repo := range repos {
+			ids, err := (&Repository{filepath.Join(dataDir, "repositories", namespace.Name(), repo.Name())}).ImageIds()
+			if err != nil {
+				continue
+			}
+
+			for _, id := range ids {
+				size := fileSize(filepath.Join(dataDir, "images", id, "layer"))
+				usage[namespace.Name()+"/"+repo.Name()] += size
+				if !seen[id] {
+					seen[id] = true
+					usage[namespace.Name()] += size
+				}
+				listed[id] = true
+			}
+		}
+	}
+
+	if q.Namespace != "" {
+		ids, err := readDirNames(filepath.Join(dataDir, "images"))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if !listed[id] {
+				usage[q.Namespace] += fileSize(filepath.Join(dataDir, "images", id, "layer"))
+			}
+		}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	for scope, size := range q.pending {
+		usage[scope] += size
+	}
+	q.usage = usage
+	return nil
+}
+
+// Rescan recomputes usage from disk, for after layers have been deleted.
+func (q *Quotas) Rescan() {
+	if err := q.Scan(q.dataDir); err != nil {
+		logger.Errorf("scanning quota usage %s", err)
+	}
+}
+
+// scopes returns what bytes of repo count towards, only the namespace when
+// repo is empty.
+func scopes(namespace, repo string) []string {
+	if repo == "" {
+		return []string{namespace}
+	}
+	return []string{namespace, namespace + "/" + repo}
+}
+
+// Reserve charges size bytes to the repository and its namespace unless that
+// would take either over its limit, checking and charging in one step. The
+// bytes are pending until committed or released.
+func (q *Quotas) Reserve(namespace, repo string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	for _, scope := range scopes(namespace, repo) {
+		if limit, ok := q.Limits[scope]; ok && q.usage[scope]+size > limit {
+			return &QuotaExceededError{scope, q.usage[scope], limit}
+		}
+	}
+	for _, scope := range scopes(namespace, repo) {
+		q.usage[scope] += size
+		q.pending[scope] += size
+	}
+	return nil
+}
+
+// Commit runs store, which puts reserved bytes where Scan will find them,
+// and settles the bytes once it succeeds.
+func (q *Quotas) Commit(namespace, repo string, size int64, store func() error) error {
+	q.scanning.RLock()
+	defer q.scanning.RUnlock()
+
+	if err := store(); err != nil {
+		return err
+	}
+	q.change(namespace, repo, 0, size)
+	return nil
+}
+
+// Release gives back reserved bytes which were never stored.
+func (q *Quotas) Release(namespace, repo string, size int64) {
+	q.change(namespace, repo, size, size)
+}
+
+func (q *Quotas) change(namespace, repo string, used, pending int64) {
+	q.Lock()
+	defer q.Unlock()
+	for _, scope := range scopes(namespace, repo) {
+		q.usage[scope] -= used
+		if q.pending[scope] -= pending; q.pending[scope] <= 0 {
+			delete(q.pending, scope)
+		}
+	}
+}
+
+// Upload reserves the size an upload announces and wraps its body so bytes
+// beyond that are reserved as they are read, failing the copy once the
+// repository would go over quota.
+func (q *Quotas) Upload(namespace, repo string, size int64, r io.ReadCloser) (*QuotaUpload, error) {
+	if err := q.Reserve(namespace, repo, size); err != nil {
+		return nil, err
+	}
+	upload := &QuotaUpload{ReadCloser: r, quotas: q, namespace: namespace, repo: repo}
+	if size > 0 {
+		upload.reserved = size
+	}
+	return upload, nil
+}
+
+func (q *Quotas) Usage() map[string]*QuotaUsage {
+	q.Lock()
+	defer q.Unlock()
+
+	usage := make(map[string]*QuotaUsage)
+	for scope, used := range q.usage {
+		usage[scope] = &QuotaUsage{Used: used}
+	}
+	for scope, limit := range q.Limits {
+		if _, ok := usage[scope]; !ok {
+			usage[scope] = &QuotaUsage{}
+		}
+		usage[scope].Limit = limit
+	}
+	return usage
+}
+
+type QuotaUpload struct {
+	io.ReadCloser
+	quotas          *Quotas
+	namespace, repo string
+	read, reserved  int64
+}
+
+func (u *QuotaUpload) Read(p []byte) (n int, err error) {
+	n, err = u.ReadCloser.Read(p)
+	u.read += int64(n)
+	if u.read > u.reserved {
+		if qerr := u.quotas.Reserve(u.namespace, u.repo, u.read-u.reserved); qerr != nil {
+			return n, qerr
+		}
+		u.reserved = u.read
+	}
+	return
+}
+
+// Finish releases what was reserved beyond the bytes read, which stay
+// reserved, and returns how many were read.
+func (u *QuotaUpload) Finish() int64 {
+	u.release(u.read)
+	return u.read
+}
+
+// Abort releases everything reserved for an upload which failed.
+func (u *QuotaUpload) Abort() {
+	u.release(0)
+}
+
+func (u *QuotaUpload) release(keep int64) {
+	if u.reserved > keep {
+		u.quotas.Release(u.namespace, u.repo, u.reserved-keep)
+		u.reserved = keep
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func (t *testSuite) TestParseQuotas() {
+	limits, err := ParseQuotas("dynport=10G, dynport/redis=512M,small=100")
+	t.Nil(err)
+	t.Equal(int64(10<<30), limits["dynport"])
+	t.Equal(int64(512<<20), limits["dynport/redis"])
+	t.Equal(int64(100), limits["small"])
+
+	_, err = ParseQuotas("dynport=lots")
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestQuotaScan() {
+	quotas := NewQuotas("fixtures/index", "", nil)
+	usage := quotas.Usage()
+	t.Equal(int64(3*93), usage["dynport"].Used)
+	t.Equal(int64(3*93), usage["dynport/redis"].Used)
+	t.Equal(0, len(NewQuotas(resetTmpDataDir(), "", nil).Usage()))
+}
+
+func (t *testSuite) TestQuotaExceeded() {
+	h := NewHandler(resetTmpDataDir(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	h.Quotas.Limits = map[string]int64{"dynport/test": 8}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	client := http.Client{}
+	req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/test/", bytes.NewReader([]byte("[]")))
+	req.SetBasicAuth("user", "pass")
+	rsp, _ := client.Do(req)
+	token := rsp.Header.Get("X-Docker-Token")
+	t.True(token != "")
+
+	req, _ = http.NewRequest("PUT", ser.URL+"/v1/images/abc123/layer", bytes.NewReader([]byte("12345")))
+	req.Header.Set("Authorization", "Token "+token)
+	rsp, _ = client.Do(req)
+	t.Equal(200, rsp.StatusCode)
+
+	req, _ = http.NewRequest("PUT", ser.URL+"/v1/images/abc456/layer", bytes.NewReader([]byte("12345")))
+	req.Header.Set("Authorization", "Token "+token)
+	rsp, _ = client.Do(req)
+	t.Equal(403, rsp.StatusCode)
+
+	req, _ = http.NewRequest("GET", ser.URL+"/v1/_admin/quotas", nil)
+	rsp, _ = client.Do(req)
+	t.Equal(401, rsp.StatusCode)
+
+	req.SetBasicAuth("user", "pass")
+	rsp, _ = client.Do(req)
+	t.Equal(200, rsp.StatusCode)
+
+	usage := map[string]*QuotaUsage{}
+	json.NewDecoder(rsp.Body).Decode(&usage)
+	rsp.Body.Close()
+	t.Equal(int64(5), usage["dynport/test"].Used)
+	t.Equal(int64(8), usage["dynport/test"].Limit)
+}
+
+func (t *testSuite) TestQuotaReserveIsAtomic() {
+	quotas := NewQuotas(resetTmpDataDir(), "dynport", map[string]int64{"dynport/test": 20})
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	reserved := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if quotas.Reserve("dynport", "test", 5) == nil {
+				lock.Lock()
+				reserved++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	t.Equal(4, reserved)
+
+	// reservations outlive a scan until they are released
+	t.Nil(quotas.Scan(quotas.dataDir))
+	t.Equal(int64(20), quotas.Usage()["dynport/test"].Used)
+	quotas.Release("dynport", "test", 20)
+	t.Equal(int64(0), quotas.Usage()["dynport/test"].Used)
+}
+
+func (t *testSuite) TestQuotaOutsidePush() {
+	h := NewHandler(resetTmpDataDir(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	h.Quotas.Limits = map[string]int64{"dynport": 8}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	put := func(id string) int {
+		req, _ := http.NewRequest("PUT", ser.URL+"/v1/images/"+id+"/layer", bytes.NewReader([]byte("12345")))
+		req.SetBasicAuth("user", "pass")
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(200, put("abc123"))
+	// the same layer again adds nothing
+	t.Equal(200, put("abc123"))
+	t.Equal(403, put("abc456"))
+	t.Equal(int64(5), h.Quotas.Usage()["dynport"].Used)
+
+	// unlisted layers are still counted by a scan
+	h.Quotas.Rescan()
+	t.Equal(int64(5), h.Quotas.Usage()["dynport"].Used)
+}
+
+func (t *testSuite) TestQuotaAfterDelete() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+	t.Equal(int64(3*93), h.Quotas.Usage()["dynport/redis"].Used)
+
+	req, _ := http.NewRequest("DELETE", ser.URL+"/v1/repositories/dynport/redis/", nil)
+	req.SetBasicAuth("user", "pass")
+	rsp, err := http.DefaultClient.Do(req)
+	t.Nil(err)
+	rsp.Body.Close()
+	t.Equal(200, rsp.StatusCode)
+
+	// the images are no longer listed by any repository but are still stored
+	usage := h.Quotas.Usage()
+	t.True(usage["dynport/redis"] == nil)
+	t.Equal(int64(3*93), usage["dynport"].Used)
+
+	report, err := h.store().GC(0, 0, false)
+	t.Nil(err)
+	t.Equal(3, len(report.Removed))
+	h.Quotas.Rescan()
+	t.True(h.Quotas.Usage()["dynport"] == nil)
+}
+
+func (t *testSuite) TestQuotaScanDuringCommit() {
+	quotas := NewQuotas(resetTmpDataDir(), "dynport", nil)
+	t.Nil(quotas.Reserve("dynport", "", 5))
+
+	stored := make(chan bool)
+	go quotas.Commit("dynport", "", 5, func() error {
+		image := &Image{filepath.Join(quotas.dataDir, "images", "abc123")}
+		err := writeFile(image.LayerPath(), nopCloser([]byte("12345")))
+		close(stored)
+		// a scan starting now sees the layer, it has to wait for the settle
+		time.Sleep(50 * time.Millisecond)
+		return err
+	})
+
+	<-stored
+	t.Nil(quotas.Scan(quotas.dataDir))
+	t.Equal(int64(5), quotas.Usage()["dynport"].Used)
+}
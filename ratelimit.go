@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the limits used for namespaces without their own entry
+const defaultLimitNamespace = "*"
+
+var layerUploadRegexp = regexp.MustCompile(`^/v\d+/images/[^/]+/layer$`)
+var namespaceRegexp = regexp.MustCompile(`^/v\d+/repositories/([^/]+)/`)
+
+// SessionFinder is implemented by authenticators which can find an existing
+// session by token without side effects.
+type SessionFinder interface {
+	FindSession(token string) (*Session, bool)
+}
+
+// LoginFinder is implemented by authenticators which can tell the login a
+// request authenticates as without side effects.
+type LoginFinder interface {
+	FindLogin(r *http.Request) (string, bool)
+}
+
+// how long checked basic credentials are remembered, so each request doesn't
+// hash the password once more
+const loginCacheTTL = time.Minute
+
+type cachedLogin struct {
+	login   string
+	expires time.Time
+}
+
+// RateLimit holds the limits applied to each client of a namespace, zero
+// values mean unlimited.
+type RateLimit struct {
+	Reads, Writes float64 // requests per second
+	Burst         int
+	Uploads       int // concurrent layer uploads
+}
+
+// ParseRateLimits reads limits in the form
+//
+//	*=reads:20,writes:5,burst:40,uploads:4;dynport=reads:100
+//
+// where * provides the defaults for namespaces not listed.
+func ParseRateLimits(spec string) (map[string]*RateLimit, error) {
+	limits := make(map[string]*RateLimit)
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		pair := strings.SplitN(entry, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid rate limit %q", entry)
+		}
+
+		limit := &RateLimit{}
+		for _, setting := range strings.Split(pair[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(setting), ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid rate limit setting %q", setting)
+			}
+
+			value, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("invalid rate limit value %q", setting)
+			}
+
+			switch kv[0] {
+			case "reads":
+				limit.Reads = value
+			case "writes":
+				limit.Writes = value
+			case "burst":
+				limit.Burst = int(value)
+			case "uploads":
+				limit.Uploads = int(value)
+			default:
+				return nil, fmt.Errorf("unknown rate limit setting %q", kv[0])
+			}
+		}
+
+		limits[strings.TrimSpace(pair[0])] = limit
+	}
+
+	return limits, nil
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time passed and removes a token, returning
+// how long to wait for one when the bucket is empty.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// RateLimiter sits in front of the handler and applies per client token
+// buckets and upload caps, clients are keyed by login when they present
+// valid credentials or a session token and by address otherwise.
+type RateLimiter struct {
+	sync.Mutex
+	Handler   *Handler
+	Limits    map[string]*RateLimit
+	buckets   map[string]*tokenBucket
+	uploads   map[string]int
+	logins    map[string]*cachedLogin
+	lastSweep time.Time
+}
+
+func NewRateLimiter(handler *Handler, limits map[string]*RateLimit) *RateLimiter {
+	return &RateLimiter{
+		Handler:   handler,
+		Limits:    limits,
+		buckets:   make(map[string]*tokenBucket),
+		uploads:   make(map[string]int),
+		logins:    make(map[string]*cachedLogin),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace, limit := l.limitFor(r)
+	if limit == nil {
+		l.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	client := l.clientKey(r)
+
+	rate := limit.Reads
+	kind := "read"
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rate = limit.Writes
+		kind = "write"
+	}
+
+	if rate > 0 {
+		if wait := l.take(namespace+"|"+kind+"|"+client, rate, limit.Burst); wait > 0 {
+			tooManyRequests(w, wait, fmt.Sprintf("%s rate limit exceeded for %s", kind, client))
+			return
+		}
+	}
+
+	if limit.Uploads > 0 && r.Method == "PUT" && layerUploadRegexp.MatchString(r.URL.Path) {
+		if !l.acquireUpload(client, limit.Uploads) {
+			tooManyRequests(w, time.Second, fmt.Sprintf("too many concurrent uploads for %s", client))
+			return
+		}
+		defer l.releaseUpload(client)
+	}
+
+	l.Handler.ServeHTTP(w, r)
+}
+
+func (l *RateLimiter) limitFor(r *http.Request) (string, *RateLimit) {
+	namespace := l.Handler.Namespace
+	if m := namespaceRegexp.FindStringSubmatch(r.URL.Path); m != nil {
+		namespace = m[1]
+	}
+
+	if limit, ok := l.Limits[namespace]; ok {
+		return namespace, limit
+	}
+	return defaultLimitNamespace, l.Limits[defaultLimitNamespace]
+}
+
+func (l *RateLimiter) clientKey(r *http.Request) string {
+	if login, ok := l.login(r); ok {
+		return "user:" + login
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// login returns the login of the request, remembering basic credentials
+// which checked out for a while.
+func (l *RateLimiter) login(r *http.Request) (string, bool) {
+	finder, ok := l.Handler.Auth.(LoginFinder)
+	header := r.Header.Get("Authorization")
+	if !ok || header == "" {
+		return "", false
+	}
+
+	basic := strings.HasPrefix(header, "Basic ")
+	key := tokenHash(header)
+	if basic {
+		l.Lock()
+		cached, ok := l.logins[key]
+		l.Unlock()
+		if ok && time.Now().Before(cached.expires) {
+			return cached.login, true
+		}
+	}
+
+	login, ok := finder.FindLogin(r)
+	if ok && basic {
+		l.Lock()
+		l.sweep(time.Now())
+		l.logins[key] = &cachedLogin{login, time.Now().Add(loginCacheTTL)}
+		l.Unlock()
+	}
+	return login, ok
+}
+
+func (l *RateLimiter) take(key string, rate float64, burst int) time.Duration {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{rate: rate, burst: burst, tokens: float64(burst), last: now}
+		l.buckets[key] = bucket
+	}
+	return bucket.take(now)
+}
+
+// sweep drops buckets idle long enough to have refilled completely, they
+// behave exactly like new ones, so the map doesn't grow with every client.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.refill(now); bucket.tokens >= float64(bucket.burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, cached := range l.logins {
+		if now.After(cached.expires) {
+			delete(l.logins, key)
+		}
+	}
+}
+
+func (l *RateLimiter) acquireUpload(client string, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.uploads[client] >= max {
+		return false
+	}
+	l.uploads[client]++
+	return true
+}
+
+func (l *RateLimiter) releaseUpload(client string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.uploads[client]--; l.uploads[client] <= 0 {
+		delete(l.uploads, client)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Add("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, NewApiError(http.StatusTooManyRequests, CodeTooManyRequests, "%s", message))
+}
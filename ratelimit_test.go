@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+func (t *testSuite) TestParseRateLimits() {
+	limits, err := ParseRateLimits("*=reads:20,writes:5,burst:40,uploads:4; dynport=reads:100")
+	t.Nil(err)
+	t.Equal(20.0, limits["*"].Reads)
+	t.Equal(5.0, limits["*"].Writes)
+	t.Equal(40, limits["*"].Burst)
+	t.Equal(4, limits["*"].Uploads)
+	t.Equal(100.0, limits["dynport"].Reads)
+
+	_, err = ParseRateLimits("*=reads:fast")
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestRateLimiter() {
+	limits, _ := ParseRateLimits("*=reads:1,burst:2")
+	ser := httptest.NewServer(NewRateLimiter(NewHandler(resetTmpDataDir(), "dynport", nil), limits))
+	defer ser.Close()
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.Get(ser.URL + "/v1/_ping")
+		t.Equal(200, r.StatusCode)
+	}
+
+	r, _ := http.Get(ser.URL + "/v1/_ping")
+	t.Equal(429, r.StatusCode)
+	t.Equal("1", r.Header.Get("Retry-After"))
+
+	// writes have no limit configured
+	req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/test/images", nil)
+	r, _ = http.DefaultClient.Do(req)
+	t.Equal(204, r.StatusCode)
+}
+
+func (t *testSuite) TestRateLimiterKeysByLogin() {
+	limits, _ := ParseRateLimits("*=reads:1,burst:1")
+	h := NewHandler(resetTmpDataDir(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(NewRateLimiter(h, limits))
+	defer ser.Close()
+
+	get := func(login, password string) int {
+		req, _ := http.NewRequest("GET", ser.URL+"/v1/_ping", nil)
+		if login != "" {
+			req.SetBasicAuth(login, password)
+		}
+		r, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	// logins sharing an address have a bucket each
+	t.Equal(200, get("mark", "pass"))
+	t.Equal(429, get("mark", "pass"))
+	t.Equal(200, get("tim", "pass"))
+
+	// credentials which don't check out count against the address
+	t.Equal(200, get("mark", "wrong"))
+	t.Equal(429, get("", ""))
+}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
+// tag names as docker allows them, they never start with a dot
+var tagNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+func validateTagName(tag string) error {
+	if !tagNameRegexp.MatchString(tag) {
+		return badRequest("invalid tag name %q", tag)
+	}
+	return nil
+}
+
 type Repository struct {
 	Dir string
 }
@@ -22,6 +37,44 @@ func (r *Repository) IndexPath() string {
 	return r.Dir + "/_index"
 }
 
+func (r *Repository) TagPath(tag string) string {
+	return r.Dir + "/tags/" + tag
+}
+
+func (r *Repository) TagMetaPath(tag string) string {
+	return r.Dir + "/_tagmeta/" + tag
+}
+
+// TagMeta records who pushed a tag and when.
+type TagMeta struct {
+	PushedBy string    `json:"pushed_by,omitempty"`
+	PushedAt time.Time `json:"pushed_at"`
+}
+
+// TagMeta returns what was recorded when the tag was pushed, falling back to
+// the tag file's modification time for tags pushed before this was kept.
+func (r *Repository) TagMeta(tag string) *TagMeta {
+	meta := &TagMeta{}
+	if data, err := ioutil.ReadFile(r.TagMetaPath(tag)); err == nil {
+		if err := json.Unmarshal(data, meta); err == nil {
+			return meta
+		}
+	}
+
+	if stat, err := os.Stat(r.TagPath(tag)); err == nil {
+		meta.PushedAt = stat.ModTime()
+	}
+	return meta
+}
+
+func (r *Repository) WriteTagMeta(tag string, meta *TagMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFile(r.TagMetaPath(tag), ioutil.NopCloser(bytes.NewReader(data)))
+}
+
 func (r *Repository) Tags() (m map[string]string) {
 	m = make(map[string]string)
 	files, err := filepath.Glob(r.Dir + "/tags/*")
@@ -30,9 +83,42 @@ func (r *Repository) Tags() (m map[string]string) {
 	}
 	for _, path := range files {
 		name := filepath.Base(path)
+		// left by a write in progress or one that failed
+		if isTempFile(name) {
+			continue
+		}
 		if data, err := ioutil.ReadFile(path); err == nil {
-			m[name] = strings.Replace(string(data), `"`, "", -1)
+			m[name] = tagImageId(data)
 		}
 	}
 	return
 }
+
+type RepositoryImage struct {
+	Id       string `json:"id"`
+	Checksum string `json:"checksum,omitempty"`
+	Tag      string `json:"Tag,omitempty"`
+}
+
+// ImageIds returns the ids listed in the repository images file.
+func (r *Repository) ImageIds() (ids []string, err error) {
+	data, err := r.Images()
+	if err != nil {
+		return
+	}
+
+	var images []RepositoryImage
+	if err = json.Unmarshal(data, &images); err != nil {
+		return
+	}
+
+	for _, image := range images {
+		ids = append(ids, image.Id)
+	}
+	return
+}
+
+// tagImageId reads the image id from the json string stored for a tag.
+func tagImageId(value []byte) string {
+	return strings.Replace(string(value), `"`, "", -1)
+}
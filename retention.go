@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which tags of the repositories matching a glob
+// are kept. A tag is kept when it matches one of Keep, is one of the
+// KeepLast most recently pushed or was pushed within MaxAge, the rest
+// expire. Protected tags never expire.
+type RetentionPolicy struct {
+	Repositories string   `json:"repositories"`
+	KeepLast     int      `json:"keep_last,omitempty"`
+	Keep         []string `json:"keep,omitempty"`
+	MaxAge       string   `json:"max_age,omitempty"`
+	maxAge       time.Duration
+}
+
+func (p *RetentionPolicy) validate() (err error) {
+	if _, err = path.Match(p.Repositories, ""); err != nil || p.Repositories == "" {
+		return fmt.Errorf("invalid repositories pattern %q", p.Repositories)
+	}
+	for _, pattern := range p.Keep {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid keep pattern %q", pattern)
+		}
+	}
+	if p.MaxAge != "" {
+		if p.maxAge, err = time.ParseDuration(p.MaxAge); err != nil {
+			return fmt.Errorf("invalid max_age %q", p.MaxAge)
+		}
+	}
+	return nil
+}
+
+func (p *RetentionPolicy) keeps(tag string) bool {
+	for _, pattern := range p.Keep {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadRetentionPolicies reads a json list of policies, the first policy
+// matching a repository applies to it.
+func LoadRetentionPolicies(file string) ([]*RetentionPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []*RetentionPolicy{}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+
+	for _, policy := range policies {
+		if err := policy.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+type ExpiredTag struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	ImageId    string    `json:"image_id"`
+	PushedAt   time.Time `json:"pushed_at"`
+}
+
+type RetentionReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Expired []*ExpiredTag `json:"expired"`
+	*GCReport
+}
+
+// ApplyRetention moves the tags the policies don't keep into the trash and
+// then collects garbage, or with dryRun only reports what would go.
+func (s *Store) ApplyRetention(policies []*RetentionPolicy, grace, trash time.Duration, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{DryRun: dryRun, Expired: []*ExpiredTag{}}
+
+	names, err := s.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		for _, policy := range policies {
+			if matched, _ := path.Match(policy.Repositories, name); matched {
+				report.Expired = append(report.Expired, s.expiredTags(name, policy)...)
+				break
+			}
+		}
+	}
+
+	skip := make(map[string]bool)
+	expired := report.Expired[:0]
+	for _, tag := range report.Expired {
+		if dryRun {
+			// expired tags go into the trash, which keeps their images
+			// unless it is purged straight away
+			if trash <= 0 {
+				skip[tag.Repository+":"+tag.Tag] = true
+			}
+			expired = append(expired, tag)
+			continue
+		}
+		_, err := s.TrashTag(tag.Repository, tag.Tag, &TagHistoryEntry{User: "retention"}, true)
+		if _, protected := err.(*ProtectionError); protected {
+			// protected since the tags were looked at
+			logger.Infof("retention kept %s:%s, %s", tag.Repository, tag.Tag, err)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		expired = append(expired, tag)
+		metrics.Add("retention_tags_expired", 1)
+		logger.Infof("retention expired %s:%s", tag.Repository, tag.Tag)
+	}
+	report.Expired = expired
+
+	report.GCReport, err = s.collect(grace, trash, dryRun, skip)
+	return report, err
+}
+
+func (s *Store) expiredTags(name string, policy *RetentionPolicy) (expired []*ExpiredTag) {
+	if policy.KeepLast <= 0 && policy.maxAge <= 0 {
+		return
+	}
+
+	repo := s.Repository(name)
+
+	candidates := []*ExpiredTag{}
+	for tag, id := range repo.Tags() {
+		if policy.keeps(tag) || repo.CheckTagDelete(tag, true) != nil {
+			continue
+		}
+		candidates = append(candidates, &ExpiredTag{name, tag, id, repo.TagMeta(tag).PushedAt})
+	}
+
+	// newest first, so the first KeepLast are the ones to keep
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].PushedAt.Equal(candidates[j].PushedAt) {
+			return candidates[i].Tag < candidates[j].Tag
+		}
+		return candidates[i].PushedAt.After(candidates[j].PushedAt)
+	})
+
+	cutoff := time.Now().Add(-policy.maxAge)
+	for i, candidate := range candidates {
+		if i < policy.KeepLast || (policy.maxAge > 0 && candidate.PushedAt.After(cutoff)) {
+			continue
+		}
+		expired = append(expired, candidate)
+	}
+	return
+}
+
+// RetentionJob applies the retention policies every Interval, collecting
+// garbage even when there are no policies. The removed images are dropped
+// from Images and quota usage is counted again afterwards, when given.
+type RetentionJob struct {
+	Store    *Store
+	Images   *ImageIndex
+	Quotas   *Quotas
+	Policies []*RetentionPolicy
+	Interval time.Duration
+	Grace    time.Duration
+	Trash    time.Duration
+	stop     chan struct{}
+}
+
+func NewRetentionJob(store *Store, policies []*RetentionPolicy, interval, trash time.Duration) *RetentionJob {
+	return &RetentionJob{Store: store, Policies: policies, Interval: interval, Grace: time.Hour, Trash: trash, stop: make(chan struct{})}
+}
+
+func (j *RetentionJob) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(j.Interval):
+			case <-j.stop:
+				return
+			}
+
+			report, err := j.Store.ApplyRetention(j.Policies, j.Grace, j.Trash, false)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			if j.Images != nil {
+				report.forget(j.Images)
+			}
+			if j.Quotas != nil {
+				j.Quotas.Rescan()
+			}
+			if report != nil && report.GCReport != nil {
+				logger.Infof("retention expired %d tags, purged %d trash items and removed %d images freeing %d bytes", len(report.Expired), len(report.Purged), len(report.Removed), report.Freed)
+			}
+		}
+	}()
+}
+
+// forget drops the images removed by a run from index, a run which failed
+// part way still reports what it removed.
+func (r *RetentionReport) forget(index *ImageIndex) {
+	if r == nil || r.GCReport == nil {
+		return
+	}
+	for _, id := range r.Removed {
+		index.Remove(id)
+	}
+}
+
+func (j *RetentionJob) Stop() {
+	close(j.stop)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (t *testSuite) TestRetention() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+	os.Remove(repo.TagPath("latest"))
+
+	tag := func(name, id string, age time.Duration) {
+		repo.SetTag(name, []byte(`"`+id+`"`), &TagHistoryEntry{})
+		repo.WriteTagMeta(name, &TagMeta{PushedAt: time.Now().Add(-age)})
+	}
+	tag("v1", "8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", 720*time.Hour)
+	tag("new", "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", 0)
+	tag("recent", "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", 24*time.Hour)
+	tag("protected", "0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", 240*time.Hour)
+	tag("old", "e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", 120*time.Hour)
+	repo.WriteProtectionRules([]*ProtectionRule{{Pattern: "protected", Mode: ProtectDenyDelete}})
+
+	file := filepath.Join(store.Dir, "retention.json")
+	ioutil.WriteFile(file, []byte(`[
+		{"repositories": "other/*"},
+		{"repositories": "dynport/*", "keep_last": 1, "keep": ["v*"], "max_age": "72h"}
+	]`), 0644)
+
+	policies, err := LoadRetentionPolicies(file)
+	t.Nil(err)
+
+	report, err := store.ApplyRetention(policies, 0, 0, true)
+	t.Nil(err)
+	t.Equal(1, len(report.Expired))
+	t.Equal("old", report.Expired[0].Tag)
+	t.Equal([]string{"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"}, report.Removed)
+	t.Equal(5, len(repo.Tags()))
+
+	report, err = store.ApplyRetention(policies, 0, 0, false)
+	t.Nil(err)
+	t.Equal(1, len(report.Expired))
+	t.Equal(4, len(repo.Tags()))
+	t.Equal(1, len(report.Purged))
+	_, err = os.Stat(store.Image("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5").Dir)
+	t.True(os.IsNotExist(err))
+
+	history, _ := repo.TagHistory("old")
+	t.Equal("delete", history[len(history)-1].Action)
+	t.Equal("retention", history[len(history)-1].User)
+
+	// nothing left to expire
+	report, err = store.ApplyRetention(policies, 0, 0, false)
+	t.Nil(err)
+	t.Equal(0, len(report.Expired))
+	t.Equal(0, len(report.Removed))
+}
+
+func (t *testSuite) TestRetentionDryRunWithTrash() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+	repo.WriteTagMeta("latest", &TagMeta{PushedAt: time.Now().Add(-240 * time.Hour)})
+
+	file := filepath.Join(store.Dir, "retention.json")
+	ioutil.WriteFile(file, []byte(`[{"repositories": "dynport/*", "max_age": "72h"}]`), 0644)
+	policies, err := LoadRetentionPolicies(file)
+	t.Nil(err)
+
+	// the trashed tag keeps its images for the week they stay in the trash
+	dryRun, err := store.ApplyRetention(policies, 0, 168*time.Hour, true)
+	t.Nil(err)
+	t.Equal(1, len(dryRun.Expired))
+	t.Equal(0, len(dryRun.Removed))
+
+	report, err := store.ApplyRetention(policies, 0, 168*time.Hour, false)
+	t.Nil(err)
+	t.Equal(dryRun.Expired[0].Tag, report.Expired[0].Tag)
+	t.Equal(dryRun.Removed, report.Removed)
+	ids, _ := store.ImageIds()
+	t.Equal(3, len(ids))
+}
+
+func (t *testSuite) TestRetentionPolicyValidation() {
+	file := filepath.Join(resetTmpDataDir(), "retention.json")
+
+	ioutil.WriteFile(file, []byte(`[{"repositories": "dynport/*", "max_age": "a week"}]`), 0644)
+	_, err := LoadRetentionPolicies(file)
+	t.True(err != nil)
+
+	ioutil.WriteFile(file, []byte(`[{"repositories": "dynport/*", "keep": ["[v"]}]`), 0644)
+	_, err = LoadRetentionPolicies(file)
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestRetentionForgetsRemovedImages() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	h.Admins = []string{"admin"}
+	h.TrashRetention = 0
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	store := h.store()
+	store.Repository("dynport/redis").WriteTagMeta("latest", &TagMeta{PushedAt: time.Now().Add(-240 * time.Hour)})
+	old := time.Now().Add(-2 * time.Hour)
+	filepath.Walk(filepath.Join(store.Dir, "images"), func(path string, info os.FileInfo, err error) error {
+		return os.Chtimes(path, old, old)
+	})
+
+	file := filepath.Join(store.Dir, "retention.json")
+	ioutil.WriteFile(file, []byte(`[{"repositories": "dynport/*", "max_age": "72h"}]`), 0644)
+	policies, err := LoadRetentionPolicies(file)
+	t.Nil(err)
+	h.Retention = policies
+
+	t.Equal(1, len(h.Images.lookup("e0ac")))
+	req, _ := http.NewRequest("POST", ser.URL+"/v1/_admin/retention", nil)
+	req.SetBasicAuth("admin", "pass")
+	rsp, err := http.DefaultClient.Do(req)
+	t.Nil(err)
+	rsp.Body.Close()
+	t.Equal(200, rsp.StatusCode)
+	t.Equal(0, len(h.Images.lookup("e0ac")))
+	t.Equal(0, len(h.Images.lookup("")))
+}
+
+func (t *testSuite) TestImageIndexDropsImagesRemovedElsewhere() {
+	store := &Store{copyFixtures()}
+	index := NewImageIndex(filepath.Join(store.Dir, "images"))
+
+	// as the gc command would from another process
+	t.Nil(os.RemoveAll(store.Image("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5").Dir))
+	_, err := index.Resolve("e0ac")
+	t.Equal(ErrImageNotFound, err)
+	t.Equal(0, len(index.lookup("e0ac")))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// RevocationList is what has been revoked. Tokens are recorded by their
+// hash, logins and Before revoke every session issued before the time given.
+type RevocationList struct {
+	Tokens map[string]time.Time `json:"tokens"`
+	Logins map[string]time.Time `json:"logins"`
+	Before time.Time            `json:"before,omitempty"`
+}
+
+func (l *RevocationList) revoked(session *Session) bool {
+	if _, ok := l.Tokens[tokenHash(session.Token)]; ok {
+		return true
+	}
+	if before, ok := l.Logins[session.Login]; ok && session.IssuedAt.Before(before) {
+		return true
+	}
+	return session.IssuedAt.Before(l.Before)
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hashString(sum[:])
+}
+
+// how often the file is checked for changes made by the maintenance commands
+const defaultRevocationsInterval = time.Second
+
+// prune drops what only concerns sessions issued before cutoff, which have
+// expired by now.
+func (l *RevocationList) prune(cutoff time.Time) {
+	for hash, at := range l.Tokens {
+		if at.Before(cutoff) {
+			delete(l.Tokens, hash)
+		}
+	}
+	for login, before := range l.Logins {
+		if before.Before(cutoff) {
+			delete(l.Logins, login)
+		}
+	}
+	if l.Before.Before(cutoff) {
+		l.Before = time.Time{}
+	}
+}
+
+// Revocations keeps the revocation list in a file in the data directory,
+// so revoked sessions stay revoked across restarts. The file is checked for
+// changes every Interval, which lets the maintenance commands revoke
+// sessions of a running registry. With TTL set, the session lifetime,
+// entries no live session can match are dropped whenever the list is
+// updated.
+type Revocations struct {
+	sync.Mutex
+	Path     string
+	Interval time.Duration
+	TTL      time.Duration
+	list     *RevocationList
+	modTime  time.Time
+	size     int64
+	checked  time.Time
+}
+
+func NewRevocations(path string) *Revocations {
+	return &Revocations{Path: path, Interval: defaultRevocationsInterval, list: newRevocationList()}
+}
+
+func newRevocationList() *RevocationList {
+	return &RevocationList{Tokens: make(map[string]time.Time), Logins: make(map[string]time.Time)}
+}
+
+func (s *Store) Revocations() *Revocations {
+	return NewRevocations(s.Dir + "/_revocations")
+}
+
+// Revoked is true when session has been revoked. Should the file become
+// unreadable the last list read stays in force.
+func (r *Revocations) Revoked(session *Session) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.checked) >= r.Interval {
+		if err := r.load(); err != nil {
+			logger.Errorf("reading revocations %s", err)
+		}
+	}
+	return r.list.revoked(session)
+}
+
+// List returns a copy of the current revocation list.
+func (r *Revocations) List() (*RevocationList, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	list := newRevocationList()
+	for hash, at := range r.list.Tokens {
+		list.Tokens[hash] = at
+	}
+	for login, before := range r.list.Logins {
+		list.Logins[login] = before
+	}
+	list.Before = r.list.Before
+	return list, nil
+}
+
+// RevokeToken revokes the session with token.
+func (r *Revocations) RevokeToken(token string) error {
+	return r.update(func(list *RevocationList) {
+		list.Tokens[tokenHash(token)] = time.Now()
+	})
+}
+
+// RevokeLogin revokes the sessions of login issued before the given time.
+func (r *Revocations) RevokeLogin(login string, before time.Time) error {
+	return r.update(func(list *RevocationList) {
+		if before.After(list.Logins[login]) {
+			list.Logins[login] = before
+		}
+	})
+}
+
+// RevokeBefore revokes every session issued before the given time.
+func (r *Revocations) RevokeBefore(before time.Time) error {
+	return r.update(func(list *RevocationList) {
+		if before.After(list.Before) {
+			list.Before = before
+		}
+	})
+}
+
+// update changes the list as it is on disk, so revocations made elsewhere
+// in the meantime aren't lost.
+func (r *Revocations) update(change func(list *RevocationList)) error {
+	r.Lock()
+	defer r.Unlock()
+
+	unlock := lockPath(r.Path)
+	defer unlock()
+
+	// the file may have changed without its time or size telling
+	r.modTime = time.Time{}
+	if err := r.load(); err != nil {
+		return err
+	}
+	change(r.list)
+	if r.TTL > 0 {
+		r.list.prune(time.Now().Add(-r.TTL))
+	}
+
+	data, err := json.Marshal(r.list)
+	if err != nil {
+		return err
+	}
+	tmpName, _, err := writeTemp(r.Path, nopCloser(data))
+	if err != nil {
+		return err
+	}
+	if err := commitTemp(tmpName, r.Path); err != nil {
+		return err
+	}
+	return r.load()
+}
+
+// load reads the file again when it has changed since it was last read.
+func (r *Revocations) load() error {
+	r.checked = time.Now()
+	info, err := os.Stat(r.Path)
+	if os.IsNotExist(err) {
+		r.list, r.modTime, r.size = newRevocationList(), time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return err
+	}
+	list := &RevocationList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return err
+	}
+	if list.Tokens == nil {
+		list.Tokens = make(map[string]time.Time)
+	}
+	if list.Logins == nil {
+		list.Logins = make(map[string]time.Time)
+	}
+	r.list, r.modTime, r.size = list, info.ModTime(), info.Size()
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func (t *testSuite) TestRevocationEndpoints() {
+	auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+	h := NewHandler(resetTmpDataDir(), "dynport", auth)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	admin, _ := auth.CheckAuth(basicAuthRequest("admin", "pass"))
+	lost, _ := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	kept, _ := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+
+	do := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Token "+token)
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	t.Equal(200, do("POST", "/v1/_admin/revocations", admin.Token, `{"token": "`+lost.Token+`"}`))
+	t.Equal(401, do("GET", "/v1/users/", lost.Token, ""))
+	t.Equal(200, do("GET", "/v1/users/", kept.Token, ""))
+	t.Equal(400, do("POST", "/v1/_admin/revocations", admin.Token, `{}`))
+
+	t.Equal(200, do("POST", "/v1/_admin/revocations", admin.Token, `{"login": "mark"}`))
+	t.Equal(401, do("GET", "/v1/users/", kept.Token, ""))
+
+	// logging out only ends the session used
+	t.Equal(204, do("DELETE", "/v1/_session", admin.Token, ""))
+	t.Equal(401, do("GET", "/v1/_admin/revocations", admin.Token, ""))
+	_, err := auth.CheckAuth(basicAuthRequest("admin", "pass"))
+	t.Nil(err)
+}
+
+func (t *testSuite) TestRevocationsSurviveRestart() {
+	dataDir := resetTmpDataDir()
+	sessions := NewMemorySessionStore()
+
+	start := func() *BasicAuth {
+		auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+		auth.Sessions = sessions
+		NewHandler(dataDir, "dynport", auth)
+		// pick up revocations made by the commands straight away
+		auth.Revocations.Interval = 0
+		return auth
+	}
+
+	auth := start()
+	old, _ := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	time.Sleep(time.Millisecond)
+	t.Nil(runCommand(&Store{dataDir}, &bytes.Buffer{}, []string{"revoke", "before", time.Now().Format(time.RFC3339Nano)}))
+	time.Sleep(time.Millisecond)
+
+	auth = start()
+	_, err := auth.CheckAuth(tokenRequest(old.Token))
+	t.True(err != nil)
+
+	session, err := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	t.Nil(err)
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.Nil(err)
+
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(&Store{dataDir}, out, []string{"revoke", "token", session.Token}))
+	t.Nil(runCommand(&Store{dataDir}, out, []string{"revocations", "list"}))
+	t.True(bytes.Contains(out.Bytes(), []byte(tokenHash(session.Token))))
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestRevocationsPruned() {
+	revocations := (&Store{resetTmpDataDir()}).Revocations()
+	revocations.TTL = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+
+	t.Nil(revocations.update(func(list *RevocationList) {
+		list.Tokens["expired"] = old
+	}))
+	t.Nil(revocations.RevokeToken("live"))
+	t.Nil(revocations.RevokeLogin("tim", old))
+	t.Nil(revocations.RevokeLogin("mark", time.Now()))
+	t.Nil(revocations.RevokeBefore(old))
+
+	// nothing issued before the session lifetime can still be in use
+	list, err := revocations.List()
+	t.Nil(err)
+	t.Equal([]string{tokenHash("live")}, sortedKeys(list.Tokens))
+	t.Equal([]string{"mark"}, sortedKeys(list.Logins))
+	t.True(list.Before.IsZero())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// Scrubber periodically re-hashes stored layers, reading no faster than
+// Rate bytes a second, and marks images whose layer no longer matches its
+// recorded checksum as corrupt.
+type Scrubber struct {
+	Store    *Store
+	Interval time.Duration
+	Rate     int64
+	stop     chan struct{}
+}
+
+func NewScrubber(store *Store, interval time.Duration, rate int64) *Scrubber {
+	return &Scrubber{Store: store, Interval: interval, Rate: rate, stop: make(chan struct{})}
+}
+
+func (s *Scrubber) Start() {
+	go func() {
+		for {
+			s.ScrubAll()
+			select {
+			case <-time.After(s.Interval):
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *Scrubber) Stop() {
+	close(s.stop)
+}
+
+// ScrubAll checks every layer in the store and returns the ids of those
+// found to be corrupt in this pass.
+func (s *Scrubber) ScrubAll() (corrupt []string) {
+	started := time.Now()
+
+	ids, err := s.Store.ImageIds()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	for _, id := range ids {
+		ok, err := s.Scrub(s.Store.Image(id))
+		if err == errScrubStopped {
+			return
+		}
+		if err != nil {
+			logger.Errorf("scrubbing %s %s", id, err)
+			continue
+		}
+		if !ok {
+			corrupt = append(corrupt, id)
+		}
+	}
+
+	metrics.Add("scrub_passes", 1)
+	logger.Infof("scrubbed %d layers in %.03f, %d corrupt", len(ids), time.Now().Sub(started).Seconds(), len(corrupt))
+	return
+}
+
+// Scrub re-hashes the layer of an image, returning false when it doesn't
+// match the recorded checksum. Layers without one have it recorded.
+func (s *Scrubber) Scrub(image *Image) (bool, error) {
+	if image.Corrupt() {
+		return true, nil
+	}
+
+	file, err := os.Open(image.LayerPath())
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	actual, err := readChecksum(&throttledReader{r: file, rate: s.Rate, stop: s.stop, started: time.Now()})
+	if err != nil {
+		return false, err
+	}
+
+	metrics.Add("scrub_layers", 1)
+
+	data, err := ioutil.ReadFile(image.ChecksumPath())
+	if os.IsNotExist(err) {
+		return true, writeFile(image.ChecksumPath(), ioutil.NopCloser(strings.NewReader(actual)))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	expected := strings.TrimSpace(string(data))
+	if actual == expected {
+		return true, nil
+	}
+
+	metrics.Add("scrub_corrupt_layers", 1)
+	logger.WithFields(logrus.Fields{
+		"event":    "layer_corrupt",
+		"image":    image.Id(),
+		"expected": expected,
+		"actual":   actual,
+	}).Error("layer failed checksum verification")
+
+	return false, image.MarkCorrupt("recorded " + expected + " but layer hashes to " + actual)
+}
+
+// throttledReader sleeps between reads to keep to rate bytes a second.
+type throttledReader struct {
+	r       io.Reader
+	rate    int64
+	read    int64
+	started time.Time
+	stop    chan struct{}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.rate > 0 {
+		due := t.started.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+		if wait := due.Sub(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.stop:
+				return 0, errScrubStopped
+			}
+		}
+		if int64(len(p)) > t.rate {
+			p = p[:t.rate]
+		}
+	}
+
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	return n, err
+}
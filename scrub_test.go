@@ -0,0 +1,56 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func (t *testSuite) TestScrubber() {
+	dataDir := copyFixtures()
+	store := &Store{dataDir}
+	scrubber := NewScrubber(store, time.Hour, 0)
+
+	// the first pass records checksums for the fixtures
+	t.Equal(0, len(scrubber.ScrubAll()))
+
+	image := store.Image("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8")
+	ioutil.WriteFile(image.LayerPath(), []byte("rotten"), 0644)
+
+	before := metricValue("scrub_corrupt_layers")
+	t.Equal([]string{image.Id()}, scrubber.ScrubAll())
+	t.True(image.Corrupt())
+	t.Equal(before+1, metricValue("scrub_corrupt_layers"))
+
+	ser := httptest.NewServer(NewHandler(dataDir, "dynport", nil))
+	defer ser.Close()
+
+	r, _ := http.Get(ser.URL + "/v1/images/" + image.Id() + "/layer")
+	t.Equal(500, r.StatusCode)
+}
+
+func (t *testSuite) TestThrottledReader() {
+	started := time.Now()
+	reader := &throttledReader{r: &zeroReader{}, rate: 10000, started: started, stop: make(chan struct{})}
+	buf := make([]byte, 4096)
+	for read := 0; read < 12000; {
+		n, _ := reader.Read(buf)
+		read += n
+	}
+	t.True(time.Now().Sub(started) >= 150*time.Millisecond)
+}
+
+func metricValue(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+type zeroReader struct{}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
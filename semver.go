@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SemVer is a semantic version parsed from a tag name. Tags may carry a
+// leading v and leave out the minor and patch numbers, as in v2 or 2.3.
+type SemVer struct {
+	Major, Minor, Patch int64
+	Prerelease          []string
+	Build               string
+}
+
+func ParseSemVer(s string) (*SemVer, error) {
+	v := &SemVer{}
+	rest := strings.TrimPrefix(s, "v")
+
+	if i := strings.Index(rest, "+"); i >= 0 {
+		v.Build = rest[i+1:]
+		rest = rest[:i]
+	}
+	if i := strings.Index(rest, "-"); i >= 0 {
+		v.Prerelease = strings.Split(rest[i+1:], ".")
+		rest = rest[:i]
+		for _, id := range v.Prerelease {
+			if id == "" {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+		}
+	}
+
+	parts := strings.Split(rest, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	numbers := []*int64{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || n < 0 || part[0] == '+' {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+// Compare returns -1, 0 or 1 as v has lower, equal or higher precedence than
+// o, build metadata is ignored.
+func (v *SemVer) Compare(o *SemVer) int {
+	for _, d := range []int64{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	// a release has higher precedence than its prereleases
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], o.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(int64(len(v.Prerelease) - len(o.Prerelease)))
+}
+
+func (v *SemVer) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// numeric identifiers sort numerically and before alphanumeric ones
+func comparePrerelease(a, b string) int {
+	an, aerr := strconv.ParseInt(a, 10, 64)
+	bn, berr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		return sign(an - bn)
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int64) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// SemVerConstraint is a set of alternative ranges, separated by ||, each a
+// space separated list of comparisons which must all hold. Comparisons take
+// the operators =, !=, >, >=, <, <=, ~ and ^ and partial versions or x
+// wildcards, so ~2.3, ^1.2, 1.4.x and ">=1.4 <2" all work as expected.
+type SemVerConstraint struct {
+	ranges [][]*comparison
+}
+
+type comparison struct {
+	op      string
+	version *SemVer
+}
+
+func (c *comparison) check(v *SemVer) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+func ParseSemVerConstraint(s string) (*SemVerConstraint, error) {
+	c := &SemVerConstraint{}
+
+	for _, alternative := range strings.Split(s, "||") {
+		var r []*comparison
+		for _, term := range strings.Fields(alternative) {
+			comparisons, err := parseComparison(term)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, comparisons...)
+		}
+		c.ranges = append(c.ranges, r)
+	}
+	return c, nil
+}
+
+// Check returns true when the version satisfies any of the ranges.
+func (c *SemVerConstraint) Check(v *SemVer) bool {
+	for _, r := range c.ranges {
+		ok := true
+		for _, comparison := range r {
+			if ok = comparison.check(v); !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+var constraintOps = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+// parseComparison expands a single term into the comparisons it stands for,
+// upper bounds exclude prereleases of the bound itself.
+func parseComparison(term string) ([]*comparison, error) {
+	op := ""
+	for _, o := range constraintOps {
+		if strings.HasPrefix(term, o) {
+			op = o
+			break
+		}
+	}
+
+	v, parts, err := parsePartialSemVer(strings.TrimPrefix(term, op))
+	if err != nil {
+		return nil, fmt.Errorf("invalid constraint %q", term)
+	}
+
+	// the lowest version above the partial one, 1.2 -> 1.3.0-0
+	next := func(parts int) *SemVer {
+		n := &SemVer{Major: v.Major, Minor: v.Minor, Patch: v.Patch, Prerelease: []string{"0"}}
+		switch parts {
+		case 1:
+			n.Major, n.Minor, n.Patch = v.Major+1, 0, 0
+		case 2:
+			n.Minor, n.Patch = v.Minor+1, 0
+		default:
+			n.Patch = v.Patch + 1
+		}
+		return n
+	}
+	between := func(upper *SemVer) []*comparison {
+		return []*comparison{{">=", v}, {"<", upper}}
+	}
+
+	switch {
+	case parts == 0:
+		if op == "" || op == "=" || op == ">=" || op == "<=" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid constraint %q", term)
+	case op == "~":
+		if parts == 1 {
+			return between(next(1)), nil
+		}
+		return between(next(2)), nil
+	case op == "^":
+		switch {
+		case v.Major > 0 || parts == 1:
+			return between(next(1)), nil
+		case v.Minor > 0 || parts == 2:
+			return between(next(2)), nil
+		}
+		return between(next(3)), nil
+	case parts < 3 && (op == "" || op == "="):
+		return between(next(parts)), nil
+	case parts < 3 && op == ">":
+		return []*comparison{{">=", next(parts)}}, nil
+	case parts < 3 && op == "<=":
+		return []*comparison{{"<", next(parts)}}, nil
+	case op == "":
+		op = "="
+	}
+	return []*comparison{{op, v}}, nil
+}
+
+// parsePartialSemVer parses a version which may stop early or use x, X or *
+// in place of numbers, returning how many numbers were given.
+func parsePartialSemVer(s string) (*SemVer, int, error) {
+	rest := strings.TrimPrefix(s, "v")
+	numbers := rest
+	if i := strings.IndexAny(rest, "-+"); i >= 0 {
+		numbers = rest[:i]
+	}
+
+	parts := 0
+	for _, part := range strings.Split(numbers, ".") {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		parts++
+	}
+
+	if parts == 3 {
+		v, err := ParseSemVer(rest)
+		return v, parts, err
+	}
+	if numbers != rest {
+		return nil, 0, fmt.Errorf("invalid version %q", s)
+	}
+
+	given := strings.Split(numbers, ".")[:parts]
+	if parts == 0 {
+		return &SemVer{}, 0, nil
+	}
+	v, err := ParseSemVer(strings.Join(given, "."))
+	return v, parts, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServerTimeouts bounds how long clients may hold a connection without
+// making progress. There is no cap on a whole request as layers can take
+// hours to stream, instead each read of an upload has to arrive within Chunk.
+type ServerTimeouts struct {
+	Header, Idle, Chunk time.Duration
+}
+
+// NewServer returns the server for handler listening on addr.
+func NewServer(addr string, handler http.Handler, timeouts ServerTimeouts) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.Header,
+		IdleTimeout:       timeouts.Idle,
+	}
+}
+
+// uploadError is a request body which stopped before it was complete, either
+// because the client went away or stalled.
+type uploadError struct {
+	err error
+}
+
+func (e *uploadError) Error() string {
+	return fmt.Sprintf("upload interrupted: %s", e.err)
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+func (e *uploadError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.err, &netErr) && netErr.Timeout()
+}
+
+// uploadBody reads a request body, pushing the connection's read deadline
+// out by timeout before every read and giving up once the request's context
+// is cancelled.
+type uploadBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func newUploadBody(w http.ResponseWriter, r *http.Request, timeout time.Duration) *uploadBody {
+	return &uploadBody{r.Body, r.Context(), http.NewResponseController(w), timeout}
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, &uploadError{err}
+	}
+	if b.timeout > 0 {
+		// not every ResponseWriter can, the upload just goes without a deadline
+		b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.timeout > 0 {
+		// the rest of the request mustn't be held to the deadline
+		b.rc.SetReadDeadline(time.Time{})
+	} else if err != nil && err != io.EOF {
+		err = &uploadError{err}
+	}
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadServer serves h, signalling on the returned channel as each request
+// finishes.
+func uploadServer(h *Handler) (*httptest.Server, chan bool) {
+	done := make(chan bool, 1)
+	ser := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		done <- true
+	}))
+	return ser, done
+}
+
+func startLayerUpload(ser *httptest.Server, partial string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ser.URL, "http://"))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn, "PUT /v1/images/abc/layer HTTP/1.1\r\nHost: registry\r\nContent-Length: 1000\r\n\r\n%s", partial)
+	return conn, nil
+}
+
+func (t *testSuite) TestStalledUpload() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	h.ChunkTimeout = 100 * time.Millisecond
+	ser, done := uploadServer(h)
+	defer ser.Close()
+
+	conn, err := startLayerUpload(ser, "12345")
+	t.Nil(err)
+	defer conn.Close()
+
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	t.Nil(err)
+	t.Equal(408, rsp.StatusCode)
+	<-done
+
+	leftover, _ := filepath.Glob(h.DataDir + "/images/abc/*")
+	t.Equal(0, len(leftover))
+}
+
+func (t *testSuite) TestDisconnectedUpload() {
+	h := NewHandler(resetTmpDataDir(), "dynport", nil)
+	ser, done := uploadServer(h)
+	defer ser.Close()
+
+	conn, err := startLayerUpload(ser, "12345")
+	t.Nil(err)
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Failed()
+	}
+
+	leftover, _ := filepath.Glob(h.DataDir + "/images/abc/*")
+	t.Equal(0, len(leftover))
+}
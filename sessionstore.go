@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SessionStore keeps sessions and cached lookups. The in-memory store is
+// private to the process, replicas of the registry share sessions by
+// pointing at the same redis.
+type SessionStore interface {
+	Get(key string) ([]byte, bool, error)
+	// Set stores value under key, a ttl of zero keeps it until deleted.
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type MemorySessionStore struct {
+	sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemorySessionStore) Get(key string) ([]byte, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *MemorySessionStore) Set(key string, value []byte, ttl time.Duration) error {
+	entry := &memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Evict removes expired entries, which Get otherwise only notices when they
+// are asked for, returning how many went.
+func (s *MemorySessionStore) Evict() int {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	evicted := 0
+	for key, entry := range s.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(s.entries, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EvictEvery removes expired entries in the background, redis expires its
+// own.
+func (s *MemorySessionStore) EvictEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if n := s.Evict(); n > 0 {
+				logger.Debugf("evicted %d expired sessions and cache entries", n)
+			}
+		}
+	}()
+}
+
+// RedisSessionStore keeps everything in redis under Prefix.
+type RedisSessionStore struct {
+	Prefix string
+	pool   *redis.Pool
+}
+
+func NewRedisSessionStore(addr string) *RedisSessionStore {
+	pool := &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	return &RedisSessionStore{Prefix: "docker-registry:", pool: pool}
+}
+
+func (s *RedisSessionStore) Get(key string) ([]byte, bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", s.Prefix+key))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *RedisSessionStore) Set(key string, value []byte, ttl time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var err error
+	if ttl > 0 {
+		_, err = conn.Do("SET", s.Prefix+key, value, "PX", int64(ttl/time.Millisecond))
+	} else {
+		_, err = conn.Do("SET", s.Prefix+key, value)
+	}
+	return err
+}
+
+func (s *RedisSessionStore) Delete(key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", s.Prefix+key)
+	return err
+}
+
+func (s *RedisSessionStore) Close() error {
+	return s.pool.Close()
+}
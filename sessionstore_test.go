@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alicebob/miniredis"
+)
+
+func (t *testSuite) TestMemorySessionStore() {
+	store := NewMemorySessionStore()
+
+	t.Nil(store.Set("a", []byte("1"), 0))
+	t.Nil(store.Set("b", []byte("2"), 10*time.Millisecond))
+
+	value, ok, err := store.Get("a")
+	t.Nil(err)
+	t.True(ok)
+	t.Equal("1", string(value))
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = store.Get("b")
+	t.False(ok)
+
+	t.Nil(store.Delete("a"))
+	_, ok, _ = store.Get("a")
+	t.False(ok)
+}
+
+func (t *testSuite) TestRedisSessionStore() {
+	mr, err := miniredis.Run()
+	t.Nil(err)
+	defer mr.Close()
+
+	store := NewRedisSessionStore(mr.Addr())
+	defer store.Close()
+
+	t.Nil(store.Set("a", []byte("1"), 0))
+	t.Nil(store.Set("b", []byte("2"), time.Minute))
+	t.True(mr.Exists("docker-registry:a"))
+
+	value, ok, err := store.Get("a")
+	t.Nil(err)
+	t.True(ok)
+	t.Equal("1", string(value))
+
+	mr.FastForward(2 * time.Minute)
+	_, ok, err = store.Get("b")
+	t.Nil(err)
+	t.False(ok)
+
+	t.Nil(store.Delete("a"))
+	_, ok, _ = store.Get("a")
+	t.False(ok)
+}
+
+func (t *testSuite) TestSessionsSharedBetweenReplicas() {
+	mr, err := miniredis.Run()
+	t.Nil(err)
+	defer mr.Close()
+
+	replicas := []*BasicAuth{}
+	for i := 0; i < 2; i++ {
+		auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+		auth.Sessions = NewRedisSessionStore(mr.Addr())
+		replicas = append(replicas, auth)
+	}
+
+	r := &http.Request{Header: http.Header{}}
+	r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("mark:pass")))
+	session, err := replicas[0].CheckAuth(r)
+	t.Nil(err)
+
+	r.Header.Set("Authorization", "Token "+session.Token)
+	session, err = replicas[1].CheckAuth(r)
+	t.Nil(err)
+	t.Equal("mark", session.Login)
+	t.Equal(SessionExisting, session.Status)
+
+	r.Header.Set("Authorization", "Token unknown")
+	_, err = replicas[1].CheckAuth(r)
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestCachedTags() {
+	h := NewHandler(copyFixtures(), "dynport", nil)
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	getTags := func() map[string]string {
+		tags := map[string]string{}
+		rsp, err := http.Get(ser.URL + "/v1/repositories/dynport/redis/tags")
+		t.Nil(err)
+		defer rsp.Body.Close()
+		json.NewDecoder(rsp.Body).Decode(&tags)
+		return tags
+	}
+
+	// only tags which have settled are cached
+	repo := h.repository("redis")
+	settled := time.Now().Add(-time.Minute)
+	t.Nil(os.Chtimes(repo.Dir+"/tags", settled, settled))
+
+	t.Equal(1, len(getTags()))
+	key := "tags:" + repo.Dir + ":" + strconv.FormatInt(settled.UnixNano(), 10)
+	_, ok, _ := h.Cache.Get(key)
+	t.True(ok)
+
+	t.Nil(repo.SetTag("stable", []byte(`"8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c"`), &TagHistoryEntry{}))
+	tags := getTags()
+	t.Equal(2, len(tags))
+	t.Equal("8dbd9e392a964056420e5d58ca5cc376ef18e2de93b5cc90e868a1bbc8318c1c", tags["stable"])
+}
+
+func (t *testSuite) TestCachedAncestry() {
+	h := NewHandler(copyFixtures(), "dynport", nil)
+	image := h.store().Image("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5")
+
+	ancestry, err := h.cachedAncestry(image)
+	t.Nil(err)
+	t.Equal(3, len(ancestry))
+
+	cached, ok, _ := h.Cache.Get("ancestry:" + image.Id())
+	t.True(ok)
+	decoded := []string{}
+	t.Nil(json.Unmarshal(cached, &decoded))
+	t.Equal(ancestry, decoded)
+}
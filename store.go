@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Store gives access to the repositories and images kept under a data
+// directory, repository names include their namespace.
+type Store struct {
+	Dir string
+}
+
+func (s *Store) Repository(name string) *Repository {
+	return &Repository{filepath.Join(s.Dir, "repositories", name)}
+}
+
+func (s *Store) Image(id string) *Image {
+	return &Image{filepath.Join(s.Dir, "images", id)}
+}
+
+func (s *Store) ImagesDir() string {
+	return filepath.Join(s.Dir, "images")
+}
+
+// Repositories returns the sorted names of every repository in the store.
+func (s *Store) Repositories() (names []string, err error) {
+	namespaces, err := readDirNames(filepath.Join(s.Dir, "repositories"))
+	if err != nil {
+		return
+	}
+
+	for _, namespace := range namespaces {
+		repos, err := readDirNames(filepath.Join(s.Dir, "repositories", namespace))
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range repos {
+			names = append(names, namespace+"/"+repo)
+		}
+	}
+	return
+}
+
+// ImageIds returns the sorted ids of every image in the store.
+func (s *Store) ImageIds() ([]string, error) {
+	return readDirNames(s.ImagesDir())
+}
+
+// ReferencedImages returns the ids of every image reachable from a tag,
+// following the ancestry of each tagged image. Tags and repositories in the
+// trash count, so they can still be restored.
+func (s *Store) ReferencedImages() (map[string]bool, error) {
+	return s.referencedImages(nil)
+}
+
+// referencedImages ignores the tags in skip, keyed by repository:tag, and the
+// trash items in skip, keyed by id.
+func (s *Store) referencedImages(skip map[string]bool) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	names, err := s.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		for tag, id := range s.Repository(name).Tags() {
+			if referenced[id] || skip[name+":"+tag] {
+				continue
+			}
+			for _, ancestor := range s.Image(id).Ancestry() {
+				referenced[ancestor] = true
+			}
+		}
+	}
+
+	items, err := s.Trash()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if skip[item.Id] {
+			continue
+		}
+		for _, id := range s.trashedReferences(item) {
+			referenced[id] = true
+		}
+	}
+	return referenced, nil
+}
+
+type GCReport struct {
+	Purged  []*TrashItem `json:"purged"`
+	Removed []string     `json:"removed_images"`
+	Freed   int64        `json:"freed"`
+}
+
+// GC purges items trashed longer than trash ago and then removes images
+// which no tag refers to, either directly or as an ancestor. Images touched
+// within grace are kept as they may belong to a push which hasn't written its
+// tags yet.
+func (s *Store) GC(grace, trash time.Duration, dryRun bool) (*GCReport, error) {
+	return s.collect(grace, trash, dryRun, map[string]bool{})
+}
+
+func (s *Store) collect(grace, trash time.Duration, dryRun bool, skip map[string]bool) (*GCReport, error) {
+	report := &GCReport{Purged: []*TrashItem{}, Removed: []string{}}
+
+	purged, freed, err := s.PurgeTrash(trash, dryRun)
+	if purged != nil {
+		report.Purged = purged
+	}
+	report.Freed = freed
+	if err != nil {
+		return report, err
+	}
+
+	for _, item := range purged {
+		skip[item.Id] = true
+	}
+
+	referenced, err := s.referencedImages(skip)
+	if err != nil {
+		return report, err
+	}
+
+	ids, err := s.ImageIds()
+	if err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-grace)
+	for _, id := range ids {
+		image := s.Image(id)
+		if referenced[id] || image.ModTime().After(cutoff) {
+			continue
+		}
+
+		size := dirSize(image.Dir)
+		if !dryRun {
+			if err := os.RemoveAll(image.Dir); err != nil {
+				return report, err
+			}
+		}
+		report.Removed = append(report.Removed, id)
+		report.Freed += size
+	}
+	return report, nil
+}
+
+// readDirNames lists the directories within dir, treating a missing dir as
+// empty.
+func readDirNames(dir string) (names []string, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
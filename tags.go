@@ -0,0 +1,176 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// TagDetail is a tag along with what is known about the image it points at
+// and who pushed it.
+type TagDetail struct {
+	Name         string    `json:"name"`
+	ImageId      string    `json:"image_id"`
+	Created      time.Time `json:"created"`
+	PushedBy     string    `json:"pushed_by,omitempty"`
+	PushedAt     time.Time `json:"pushed_at"`
+	Size         int64     `json:"size"`
+	StoredSize   int64     `json:"stored_size"`
+	Architecture string    `json:"architecture,omitempty"`
+	version      *SemVer
+}
+
+// TagDetails describes every tag of the named repository.
+func (s *Store) TagDetails(name string) []*TagDetail {
+	repo := s.Repository(name)
+	tags := repo.Tags()
+
+	details := make([]*TagDetail, 0, len(tags))
+	for tag, id := range tags {
+		detail := &TagDetail{Name: tag, ImageId: id}
+
+		meta := repo.TagMeta(tag)
+		detail.PushedBy = meta.PushedBy
+		detail.PushedAt = meta.PushedAt
+
+		if inspection, err := s.Image(id).Inspect(); err == nil {
+			detail.Created = inspection.Created
+			detail.Size = inspection.TotalSize
+			detail.StoredSize = inspection.TotalStoredSize
+			detail.Architecture = inspection.Architecture
+		} else {
+			logger.Errorf("describing tag %s of %s %s", tag, name, err)
+		}
+
+		detail.version, _ = ParseSemVer(tag)
+		details = append(details, detail)
+	}
+	return details
+}
+
+// TagQuery selects, orders and pages tag details.
+type TagQuery struct {
+	Filter string // glob the tag name must match
+	Sort   string // name, created, pushed or semver
+	Desc   bool
+	Limit  int    // page size, zero for everything
+	Last   string // the last tag of the previous page
+}
+
+func ParseTagQuery(values map[string][]string) (*TagQuery, error) {
+	get := func(key string) string {
+		if v, ok := values[key]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	q := &TagQuery{Filter: get("filter"), Sort: get("sort"), Last: get("last"), Desc: get("order") == "desc"}
+
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	if _, ok := tagSorts[q.Sort]; !ok {
+		return nil, &queryError{"sort must be one of name, created, pushed or semver"}
+	}
+	if order := get("order"); order != "" && order != "asc" && order != "desc" {
+		return nil, &queryError{"order must be asc or desc"}
+	}
+	if _, err := path.Match(q.Filter, ""); err != nil {
+		return nil, &queryError{"invalid filter " + q.Filter}
+	}
+	if n := get("n"); n != "" {
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return nil, &queryError{"n must be a positive number"}
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+type queryError struct {
+	message string
+}
+
+func (e *queryError) Error() string {
+	return e.message
+}
+
+var tagSorts = map[string]func(a, b *TagDetail) bool{
+	"name": func(a, b *TagDetail) bool {
+		return a.Name < b.Name
+	},
+	"created": func(a, b *TagDetail) bool {
+		return a.Created.Before(b.Created)
+	},
+	"pushed": func(a, b *TagDetail) bool {
+		return a.PushedAt.Before(b.PushedAt)
+	},
+	// tags which aren't versions sort before those that are
+	"semver": func(a, b *TagDetail) bool {
+		switch {
+		case a.version == nil && b.version == nil:
+			return a.Name < b.Name
+		case a.version == nil || b.version == nil:
+			return a.version == nil
+		}
+		return a.version.Compare(b.version) < 0
+	},
+}
+
+// Apply returns the page of details the query selects, along with the total
+// number matching and whether there are more pages.
+func (q *TagQuery) Apply(details []*TagDetail) (page []*TagDetail, total int, more bool) {
+	for _, detail := range details {
+		if matched, _ := path.Match(q.Filter, detail.Name); q.Filter == "" || matched {
+			page = append(page, detail)
+		}
+	}
+
+	// ties keep name order so pages are stable
+	sort.Slice(page, func(i, j int) bool {
+		return page[i].Name < page[j].Name
+	})
+
+	less := tagSorts[q.Sort]
+	sort.SliceStable(page, func(i, j int) bool {
+		if q.Desc {
+			return less(page[j], page[i])
+		}
+		return less(page[i], page[j])
+	})
+	total = len(page)
+
+	if q.Last != "" {
+		for i, detail := range page {
+			if detail.Name == q.Last {
+				page = page[i+1:]
+				break
+			}
+		}
+	}
+
+	if q.Limit > 0 && len(page) > q.Limit {
+		return page[:q.Limit], total, true
+	}
+	return page, total, false
+}
+
+// ResolveSemVer returns the tag of the repository with the highest version
+// satisfying the constraint, tags which aren't versions are ignored.
+func (s *Store) ResolveSemVer(name string, constraint *SemVerConstraint, prerelease bool) (tag string, version *SemVer, ok bool) {
+	for candidate := range s.Repository(name).Tags() {
+		v, err := ParseSemVer(candidate)
+		if err != nil || (!prerelease && len(v.Prerelease) > 0) || !constraint.Check(v) {
+			continue
+		}
+
+		// equal versions, v2.3 and 2.3.0 say, resolve to the first by name
+		if version == nil || v.Compare(version) > 0 || (v.Compare(version) == 0 && candidate < tag) {
+			tag, version, ok = candidate, v, true
+		}
+	}
+	return
+}
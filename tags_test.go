@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+func (t *testSuite) TestParseSemVer() {
+	v, err := ParseSemVer("v2.3.1-rc.1+build5")
+	t.Nil(err)
+	t.Equal(int64(2), v.Major)
+	t.Equal(int64(3), v.Minor)
+	t.Equal(int64(1), v.Patch)
+	t.Equal([]string{"rc", "1"}, v.Prerelease)
+	t.Equal("build5", v.Build)
+
+	v, err = ParseSemVer("2.3")
+	t.Nil(err)
+	t.Equal("2.3.0", v.String())
+
+	for _, bad := range []string{"latest", "1.2.3.4", "1..2", "1.2.3-", "v"} {
+		_, err = ParseSemVer(bad)
+		t.True(err != nil, bad)
+	}
+}
+
+func (t *testSuite) TestSemVerCompare() {
+	ordered := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.10.0", "2.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := ParseSemVer(ordered[i-1])
+		b, _ := ParseSemVer(ordered[i])
+		t.Equal(-1, a.Compare(b), ordered[i-1]+" < "+ordered[i])
+		t.Equal(1, b.Compare(a), ordered[i]+" > "+ordered[i-1])
+	}
+}
+
+func (t *testSuite) TestGetRepositoryTagDetails() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	client := http.Client{}
+	for _, tag := range []string{"v1.10.0", "v1.2.0", "v1.9.0-rc1", "nightly"} {
+		req, _ := http.NewRequest("PUT", ser.URL+"/v1/repositories/dynport/redis/tags/"+tag,
+			bytes.NewReader([]byte(`"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"`)))
+		req.SetBasicAuth("mark", "pass")
+		client.Do(req)
+	}
+
+	var result struct {
+		Tags  []*TagDetail
+		Total int
+	}
+
+	r, _ := http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_detail?filter=v1.*&sort=semver&order=desc&n=2")
+	t.Equal(200, r.StatusCode)
+	json.NewDecoder(r.Body).Decode(&result)
+	r.Body.Close()
+
+	t.Equal(3, result.Total)
+	t.Equal(2, len(result.Tags))
+	t.Equal("v1.10.0", result.Tags[0].Name)
+	t.Equal("v1.9.0-rc1", result.Tags[1].Name)
+	t.Equal("mark", result.Tags[0].PushedBy)
+	t.Equal("x86_64", result.Tags[0].Architecture)
+	t.Equal(int64(34795256+144519634+131502179), result.Tags[0].Size)
+	t.True(strings.Contains(r.Header.Get("Link"), "last=v1.9.0-rc1"))
+
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_detail?filter=v1.*&sort=semver&order=desc&n=2&last=v1.9.0-rc1")
+	json.NewDecoder(r.Body).Decode(&result)
+	r.Body.Close()
+	t.Equal(1, len(result.Tags))
+	t.Equal("v1.2.0", result.Tags[0].Name)
+	t.Equal("", r.Header.Get("Link"))
+
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_detail?sort=size")
+	t.Equal(400, r.StatusCode)
+
+	// the plain v1 listing is unchanged
+	tags := map[string]string{}
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags")
+	json.NewDecoder(r.Body).Decode(&tags)
+	r.Body.Close()
+	t.Equal(5, len(tags))
+}
+
+func (t *testSuite) TestSemVerConstraint() {
+	cases := []struct {
+		constraint, version string
+		match               bool
+	}{
+		{"~2.3", "2.3.9", true},
+		{"~2.3", "2.4.0", false},
+		{"~2.3", "2.4.0-rc1", false},
+		{"~2.3.1", "2.3.0", false},
+		{"^1.2", "1.9.0", true},
+		{"^1.2", "2.0.0", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{">=1.4 <2", "1.9.9", true},
+		{">=1.4 <2", "2.0.0", false},
+		{">=1.4 <2", "1.3.0", false},
+		{"1.4.x", "1.4.7", true},
+		{"1.4", "1.5.0", false},
+		{">1.4", "1.4.9", false},
+		{"<=1.4", "1.4.9", true},
+		{"1.2.3", "1.2.3", true},
+		{"!=1.2.3", "1.2.3", false},
+		{"~1.0 || ~3.0", "3.0.1", true},
+		{"*", "0.0.1", true},
+	}
+
+	for _, c := range cases {
+		constraint, err := ParseSemVerConstraint(c.constraint)
+		t.Nil(err, c.constraint)
+		v, _ := ParseSemVer(c.version)
+		t.Equal(c.match, constraint.Check(v), c.constraint+" "+c.version)
+	}
+
+	_, err := ParseSemVerConstraint(">=banana")
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestGetRepositoryTagResolve() {
+	store := &Store{copyFixtures()}
+	for _, tag := range []string{"v2.3.1", "v2.3.10", "v2.4.0", "v2.3.11-rc1", "latest"} {
+		runCommand(store, &bytes.Buffer{}, []string{"tag", "set", "dynport/redis", tag, "e0ac"})
+	}
+
+	ser := httptest.NewServer(NewHandler(store.Dir, "dynport", nil))
+	defer ser.Close()
+
+	result := map[string]string{}
+	r, _ := http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_resolve?constraint=~2.3")
+	t.Equal(200, r.StatusCode)
+	json.NewDecoder(r.Body).Decode(&result)
+	r.Body.Close()
+	t.Equal("v2.3.11-rc1", result["tag"])
+	t.Equal("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", result["image_id"])
+
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_resolve?constraint=~2.3&prerelease=false")
+	json.NewDecoder(r.Body).Decode(&result)
+	r.Body.Close()
+	t.Equal("v2.3.10", result["tag"])
+	t.Equal("2.3.10", result["version"])
+
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_resolve?constraint=" + url.QueryEscape(">=3"))
+	t.Equal(404, r.StatusCode)
+
+	r, _ = http.Get(ser.URL + "/v1/repositories/dynport/redis/tags/_resolve?constraint=~two")
+	t.Equal(400, r.StatusCode)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenPrefix = "drt_"
+	robotPrefix       = "robot$"
+)
+
+var (
+	repositoryPathRegexp = regexp.MustCompile(`^/v\d+/repositories/`)
+	imagePathRegexp      = regexp.MustCompile(`^/v\d+/images/`)
+)
+
+var (
+	ErrTokenNotFound = errors.New("access token not found")
+	errTokenInvalid  = errors.New("invalid access token")
+)
+
+// TokenScope grants pull or push access to the repositories matching a
+// glob such as "wolfeidau/*", push includes pull.
+type TokenScope struct {
+	Repositories string `json:"repositories"`
+	Access       string `json:"access"`
+}
+
+func (s *TokenScope) validate() error {
+	if _, err := path.Match(s.Repositories, ""); err != nil || s.Repositories == "" {
+		return fmt.Errorf("invalid repositories %q", s.Repositories)
+	}
+	if s.Access != "pull" && s.Access != "push" {
+		return fmt.Errorf("invalid access %q, should be pull or push", s.Access)
+	}
+	return nil
+}
+
+func (s *TokenScope) allows(repo, access string) bool {
+	matched, _ := path.Match(s.Repositories, repo)
+	return matched && (s.Access == "push" || access == "pull")
+}
+
+// scopesAllow is true when one of scopes grants access to repo, an empty
+// repo asks whether any repository is granted access.
+func scopesAllow(scopes []*TokenScope, repo, access string) bool {
+	for _, scope := range scopes {
+		if (repo == "" && (scope.Access == "push" || access == "pull")) || scope.allows(repo, access) {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessToken is a named, scoped credential used in place of a password.
+// Tokens belong to a login or, for robot accounts, to "robot$<name>".
+type AccessToken struct {
+	Id        string        `json:"id"`
+	Name      string        `json:"name"`
+	Owner     string        `json:"owner"`
+	Robot     bool          `json:"robot,omitempty"`
+	Scopes    []*TokenScope `json:"scopes"`
+	CreatedBy string        `json:"created_by"`
+	CreatedAt time.Time     `json:"created_at"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+func (t *AccessToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+func (t *AccessToken) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, ":/ ") {
+		return fmt.Errorf("invalid token name %q", t.Name)
+	}
+	if len(t.Scopes) == 0 {
+		return errors.New("a token needs at least one scope")
+	}
+	for _, scope := range t.Scopes {
+		if err := scope.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedToken is how a token is kept on disk, only the hash of its secret
+// is stored.
+type storedToken struct {
+	*AccessToken
+	Hash string `json:"hash"`
+}
+
+// AccessTokens keeps each token as a file named by its id under Dir.
+type AccessTokens struct {
+	Dir string
+}
+
+func NewAccessTokens(dir string) *AccessTokens {
+	return &AccessTokens{Dir: dir}
+}
+
+func (s *Store) AccessTokens() *AccessTokens {
+	return NewAccessTokens(s.Dir + "/_tokens")
+}
+
+// Create stores token and returns its secret, which can't be recovered
+// later.
+func (a *AccessTokens) Create(token *AccessToken) (string, error) {
+	if err := token.validate(); err != nil {
+		return "", err
+	}
+
+	random := make([]byte, 26)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token.Id = hex.EncodeToString(random[:6])
+	token.CreatedAt = time.Now()
+	secret := accessTokenPrefix + token.Id + "_" + hex.EncodeToString(random[6:])
+
+	data, err := json.Marshal(&storedToken{token, tokenHash(secret)})
+	if err != nil {
+		return "", err
+	}
+	return secret, writeFileOnce(filepath.Join(a.Dir, token.Id), nopCloser(data))
+}
+
+func (a *AccessTokens) get(id string) (*storedToken, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, ErrTokenNotFound
+	}
+	data, err := ioutil.ReadFile(filepath.Join(a.Dir, id))
+	if os.IsNotExist(err) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &storedToken{AccessToken: &AccessToken{}}
+	return stored, json.Unmarshal(data, stored)
+}
+
+func (a *AccessTokens) Get(id string) (*AccessToken, error) {
+	stored, err := a.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return stored.AccessToken, nil
+}
+
+// List returns the tokens of owner, or every token when owner is empty,
+// oldest first.
+func (a *AccessTokens) List(owner string) ([]*AccessToken, error) {
+	infos, err := ioutil.ReadDir(a.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tokens := []*AccessToken{}
+	for _, info := range infos {
+		if info.IsDir() || isTempFile(info.Name()) {
+			continue
+		}
+		token, err := a.Get(info.Name())
+		if err != nil {
+			return nil, err
+		}
+		if owner == "" || token.Owner == owner {
+			tokens = append(tokens, token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+func (a *AccessTokens) Delete(id string) error {
+	if _, err := a.get(id); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(a.Dir, id))
+}
+
+// Active is true while the token with id exists and hasn't expired.
+func (a *AccessTokens) Active(id string) bool {
+	token, err := a.Get(id)
+	return err == nil && !token.Expired()
+}
+
+// Authenticate returns the token whose secret is given when it belongs to
+// login and hasn't expired.
+func (a *AccessTokens) Authenticate(login, secret string) (*AccessToken, error) {
+	parts := strings.SplitN(strings.TrimPrefix(secret, accessTokenPrefix), "_", 2)
+	if !isAccessToken(secret) || len(parts) != 2 {
+		return nil, errTokenInvalid
+	}
+
+	stored, err := a.get(parts[0])
+	if err == ErrTokenNotFound {
+		return nil, errTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(tokenHash(secret))) != 1 {
+		return nil, errTokenInvalid
+	}
+	if stored.Owner != login {
+		return nil, errTokenInvalid
+	}
+	if stored.Expired() {
+		return nil, fmt.Errorf("access token %s expired", stored.Name)
+	}
+	return stored.AccessToken, nil
+}
+
+func isAccessToken(password string) bool {
+	return strings.HasPrefix(password, accessTokenPrefix)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func (t *testSuite) TestAccessTokens() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	h.Admins = []string{"admin"}
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path, login, password, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(login+":"+password)))
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		defer rsp.Body.Close()
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, data
+	}
+
+	created := struct {
+		Id, Token string
+	}{}
+	status, body := do("POST", "/v1/_tokens", "mark", "pass", `{"name": "ci", "scopes": [{"repositories": "dynport/redis", "access": "pull"}]}`)
+	t.Equal(201, status)
+	t.Nil(json.Unmarshal(body, &created))
+	t.True(strings.HasPrefix(created.Token, accessTokenPrefix))
+
+	// only the hash is stored
+	stored, _ := ioutil.ReadFile(h.DataDir + "/_tokens/" + created.Id)
+	t.False(bytes.Contains(stored, []byte(created.Token)))
+
+	status, _ = do("GET", "/v1/repositories/dynport/redis/tags", "mark", created.Token, "")
+	t.Equal(200, status)
+	status, _ = do("PUT", "/v1/repositories/dynport/redis/tags/stable", "mark", created.Token, `"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"`)
+	t.Equal(403, status)
+	status, _ = do("GET", "/v1/repositories/dynport/other/tags", "mark", created.Token, "")
+	t.Equal(403, status)
+	status, _ = do("GET", "/v1/repositories/dynport/redis/tags", "tim", created.Token, "")
+	t.Equal(401, status)
+	status, _ = do("POST", "/v1/_tokens", "mark", created.Token, `{"name": "more", "scopes": [{"repositories": "*", "access": "push"}]}`)
+	t.Equal(403, status)
+
+	status, _ = do("POST", "/v1/_tokens", "mark", "pass", `{"name": "bad", "scopes": [{"repositories": "*", "access": "delete"}]}`)
+	t.Equal(400, status)
+	status, body = do("POST", "/v1/_tokens", "mark", "pass", `{"name": "old", "expires_at": "2014-01-01T00:00:00Z", "scopes": [{"repositories": "*", "access": "pull"}]}`)
+	t.Equal(201, status)
+	expired := struct{ Token string }{}
+	json.Unmarshal(body, &expired)
+	status, _ = do("GET", "/v1/repositories/dynport/redis/tags", "mark", expired.Token, "")
+	t.Equal(401, status)
+
+	status, _ = do("POST", "/v1/_tokens", "mark", "pass", `{"name": "builder", "robot": true, "scopes": [{"repositories": "dynport/*", "access": "push"}]}`)
+	t.Equal(403, status)
+	robot := struct{ Owner, Token string }{}
+	status, body = do("POST", "/v1/_tokens", "admin", "pass", `{"name": "builder", "robot": true, "scopes": [{"repositories": "dynport/*", "access": "push"}]}`)
+	t.Equal(201, status)
+	json.Unmarshal(body, &robot)
+	t.Equal("robot$builder", robot.Owner)
+	status, _ = do("PUT", "/v1/repositories/dynport/redis/tags/stable", robot.Owner, robot.Token, `"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"`)
+	t.Equal(200, status)
+	status, _ = do("GET", "/v1/_admin/quotas", robot.Owner, robot.Token, "")
+	t.Equal(403, status)
+
+	tokens := []*AccessToken{}
+	_, body = do("GET", "/v1/_tokens", "mark", "pass", "")
+	json.Unmarshal(body, &tokens)
+	t.Equal(2, len(tokens))
+	_, body = do("GET", "/v1/_tokens", "admin", "pass", "")
+	json.Unmarshal(body, &tokens)
+	t.Equal(3, len(tokens))
+
+	// deleting a token ends the sessions made with it
+	auth := h.Auth.(*BasicAuth)
+	session, err := auth.CheckAuth(basicAuthRequest("mark", created.Token))
+	t.Nil(err)
+	status, _ = do("DELETE", "/v1/_tokens/"+created.Id, "tim", "pass", "")
+	t.Equal(404, status)
+	status, _ = do("DELETE", "/v1/_tokens/"+created.Id, "mark", "pass", "")
+	t.Equal(204, status)
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.True(err != nil)
+	status, _ = do("GET", "/v1/repositories/dynport/redis/tags", "mark", created.Token, "")
+	t.Equal(401, status)
+}
+
+func (t *testSuite) TestAccessTokenScopeFollowsRoute() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path, password, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, ser.URL+path, bytes.NewReader([]byte(body)))
+		req.SetBasicAuth("mark", password)
+		rsp, err := http.DefaultClient.Do(req)
+		t.Nil(err)
+		defer rsp.Body.Close()
+		data, _ := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, data
+	}
+
+	created := struct{ Token string }{}
+	status, body := do("POST", "/v1/_tokens", "pass", `{"name": "ci", "scopes": [{"repositories": "dynport/public", "access": "push"}]}`)
+	t.Equal(201, status)
+	json.Unmarshal(body, &created)
+
+	value := `"e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5"`
+	status, _ = do("PUT", "/v1/repositories/dynport/public/tags/latest", created.Token, value)
+	t.Equal(200, status)
+	status, _ = do("PUT", "/v1/repositories/dynport/secret/tags/latest", created.Token, value)
+	t.Equal(403, status)
+
+	// routes only look at the path, so a repository in the query is ignored
+	status, _ = do("PUT", "/v1/x?/v1/repositories/dynport/secret/tags/latest", created.Token, value)
+	t.Equal(404, status)
+	status, _ = do("PUT", "/v1/repositories/dynport/public/tags/latest?/v1/repositories/dynport/secret/tags/latest", created.Token, value)
+	t.Equal(200, status)
+	_, ok := h.store().Repository("dynport/secret").Tags()["latest"]
+	t.False(ok)
+}
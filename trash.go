@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/wolfeidau/docker-registry/uuid"
+)
+
+const (
+	TrashTag        = "tag"
+	TrashRepository = "repository"
+	TrashImage      = "image"
+)
+
+var (
+	ErrTrashNotFound   = errors.New("no such item in the trash")
+	ErrRestoreConflict = errors.New("something has taken the place of the trashed item")
+	ErrImageReferenced = errors.New("image is referenced by a tag")
+)
+
+// TrashItem describes something deleted, the paths it was moved from are
+// relative to the data directory and kept under the item's own directory.
+type TrashItem struct {
+	Id         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Repository string    `json:"repository,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	ImageId    string    `json:"image_id,omitempty"`
+	DeletedBy  string    `json:"deleted_by,omitempty"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	Paths      []string  `json:"paths"`
+}
+
+func (s *Store) TrashDir() string {
+	return filepath.Join(s.Dir, "trash")
+}
+
+func (s *Store) trashItemDir(id string) string {
+	return filepath.Join(s.TrashDir(), id)
+}
+
+// TrashTag moves a tag of the named repository into the trash unless its
+// protection forbids it, recording the deletion in the tag's history. The
+// tag and the rules stay locked from the check until the tag is gone.
+func (s *Store) TrashTag(name, tag string, entry *TagHistoryEntry, admin bool) (*TrashItem, error) {
+	repo := s.Repository(name)
+
+	unlock := repo.lockTags([]string{tag})
+	defer unlock()
+
+	id, ok := repo.Tags()[tag]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if err := repo.CheckTagDelete(tag, admin); err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{Kind: TrashTag, Repository: name, Tag: tag, ImageId: id, DeletedBy: entry.User}
+	if err := s.trash(item, repo.TagPath(tag), repo.TagMetaPath(tag)); err != nil {
+		return nil, err
+	}
+
+	entry.Action = "delete"
+	entry.ImageId = ""
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = item.DeletedAt
+	}
+	return item, repo.appendTagHistory(tag, entry)
+}
+
+// TrashRepository moves a whole repository into the trash, unless one of its
+// tags is protected from deletion. Its tags and rules stay locked from the
+// check until the repository is gone.
+func (s *Store) TrashRepository(name, user string) (*TrashItem, error) {
+	repo := s.Repository(name)
+	if _, err := os.Stat(repo.Dir); err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for tag := range repo.Tags() {
+		tags = append(tags, tag)
+	}
+	unlock := repo.lockTags(tags)
+	defer unlock()
+
+	// tags written before the rules were locked are checked too
+	for tag := range repo.Tags() {
+		if err := repo.CheckTagDelete(tag, true); err != nil {
+			return nil, err
+		}
+	}
+
+	item := &TrashItem{Kind: TrashRepository, Repository: name, DeletedBy: user}
+	return item, s.trash(item, repo.Dir)
+}
+
+// TrashImage moves an image into the trash, images still referenced by a tag
+// can't be deleted.
+func (s *Store) TrashImage(id, user string) (*TrashItem, error) {
+	image := s.Image(id)
+	if _, err := os.Stat(image.Dir); err != nil {
+		return nil, err
+	}
+
+	referenced, err := s.ReferencedImages()
+	if err != nil {
+		return nil, err
+	}
+	if referenced[id] {
+		return nil, ErrImageReferenced
+	}
+
+	item := &TrashItem{Kind: TrashImage, ImageId: id, DeletedBy: user}
+	return item, s.trash(item, image.Dir)
+}
+
+// trash records the item and then moves the paths under its directory.
+func (s *Store) trash(item *TrashItem, paths ...string) error {
+	item.DeletedAt = time.Now().UTC()
+	item.Id = item.DeletedAt.Format("20060102T150405Z") + "-" + uuid.NewUUID()[:8]
+
+	for _, path := range paths {
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err == nil {
+			item.Paths = append(item.Paths, rel)
+		}
+	}
+
+	dir := s.trashItemDir(item.Id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "_item"), nopCloser(data)); err != nil {
+		return err
+	}
+
+	for _, rel := range item.Paths {
+		if err := moveFile(filepath.Join(s.Dir, rel), filepath.Join(dir, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trash returns the items in the trash, oldest first.
+func (s *Store) Trash() ([]*TrashItem, error) {
+	ids, err := readDirNames(s.TrashDir())
+	if err != nil {
+		return nil, err
+	}
+
+	items := []*TrashItem{}
+	for _, id := range ids {
+		item, err := s.TrashItem(id)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		items = append(items, item)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].DeletedAt.Before(items[j].DeletedAt)
+	})
+	return items, nil
+}
+
+func (s *Store) TrashItem(id string) (*TrashItem, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.trashItemDir(filepath.Base(id)), "_item"))
+	if os.IsNotExist(err) {
+		return nil, ErrTrashNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{}
+	return item, json.Unmarshal(data, item)
+}
+
+// Restore moves a trashed item back to where it was deleted from, provided
+// nothing has been put there since. Restoring a tag is recorded in its
+// history.
+func (s *Store) Restore(id string, entry *TagHistoryEntry) (*TrashItem, error) {
+	item, err := s.TrashItem(id)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := s.trashItemDir(item.Id)
+	for _, rel := range item.Paths {
+		if _, err := os.Stat(filepath.Join(s.Dir, rel)); err == nil {
+			return nil, ErrRestoreConflict
+		}
+	}
+
+	for _, rel := range item.Paths {
+		if err := moveFile(filepath.Join(dir, rel), filepath.Join(s.Dir, rel)); err != nil {
+			return nil, err
+		}
+	}
+
+	if item.Kind == TrashTag {
+		entry.Action = "restore"
+		entry.ImageId = item.ImageId
+		if entry.Timestamp.IsZero() {
+			entry.Timestamp = time.Now()
+		}
+		if err := s.Repository(item.Repository).appendTagHistory(item.Tag, entry); err != nil {
+			return nil, err
+		}
+	}
+	return item, os.RemoveAll(dir)
+}
+
+// PurgeTrash removes the items deleted longer than window ago.
+func (s *Store) PurgeTrash(window time.Duration, dryRun bool) (purged []*TrashItem, freed int64, err error) {
+	items, err := s.Trash()
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-window)
+	for _, item := range items {
+		if item.DeletedAt.After(cutoff) {
+			continue
+		}
+
+		dir := s.trashItemDir(item.Id)
+		size := dirSize(dir)
+		if !dryRun {
+			if err = os.RemoveAll(dir); err != nil {
+				return
+			}
+		}
+		purged = append(purged, item)
+		freed += size
+	}
+	return
+}
+
+// trashedReferences returns the images a trashed item would need when
+// restored.
+func (s *Store) trashedReferences(item *TrashItem) (ids []string) {
+	switch item.Kind {
+	case TrashTag:
+		return s.Image(item.ImageId).Ancestry()
+	case TrashRepository:
+		repo := &Repository{filepath.Join(s.trashItemDir(item.Id), "repositories", item.Repository)}
+		for _, id := range repo.Tags() {
+			ids = append(ids, s.Image(id).Ancestry()...)
+		}
+	case TrashImage:
+		image := &Image{filepath.Join(s.trashItemDir(item.Id), "images", item.ImageId)}
+		if atts, err := image.Header(); err == nil && atts.Parent != "" {
+			ids = s.Image(atts.Parent).Ancestry()
+		}
+	}
+	return
+}
+
+func moveFile(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
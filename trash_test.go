@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+func (t *testSuite) TestTrashTag() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+
+	item, err := store.TrashTag("dynport/redis", "latest", &TagHistoryEntry{User: "mark"}, false)
+	t.Nil(err)
+	t.Equal(0, len(repo.Tags()))
+
+	items, _ := store.Trash()
+	t.Equal(1, len(items))
+	t.Equal(TrashTag, items[0].Kind)
+	t.Equal("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", items[0].ImageId)
+
+	// a trashed tag keeps its images until the trash is purged
+	report, err := store.GC(0, time.Hour, false)
+	t.Nil(err)
+	t.Equal(0, len(report.Removed))
+
+	_, err = store.Restore(item.Id, &TagHistoryEntry{User: "tim"})
+	t.Nil(err)
+	t.Equal("e0acc43660ac918e0cd7f21f1020ee3078fec7b2c14006603bbc21499799e7d5", repo.Tags()["latest"])
+
+	history, _ := repo.TagHistory("latest")
+	t.Equal("delete", history[0].Action)
+	t.Equal("restore", history[1].Action)
+	t.Equal("tim", history[1].User)
+
+	items, _ = store.Trash()
+	t.Equal(0, len(items))
+	_, err = store.Restore(item.Id, &TagHistoryEntry{})
+	t.Equal(ErrTrashNotFound, err)
+
+	item, _ = store.TrashTag("dynport/redis", "latest", &TagHistoryEntry{}, false)
+	report, err = store.GC(0, 0, false)
+	t.Nil(err)
+	t.Equal(1, len(report.Purged))
+	t.Equal(3, len(report.Removed))
+	_, err = store.Restore(item.Id, &TagHistoryEntry{})
+	t.Equal(ErrTrashNotFound, err)
+}
+
+func (t *testSuite) TestTrashRepositoryAndImage() {
+	store := &Store{copyFixtures()}
+	repo := store.Repository("dynport/redis")
+
+	_, err := store.TrashImage("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", "mark")
+	t.Equal(ErrImageReferenced, err)
+
+	item, err := store.TrashRepository("dynport/redis", "mark")
+	t.Nil(err)
+	names, _ := store.Repositories()
+	t.Equal(0, len(names))
+
+	// the repository's tags still hold on to the images
+	_, err = store.TrashImage("0e03f25112cd513ade7c194109217b9381835ac2298bd0ffb61d28fbe47081a8", "mark")
+	t.Equal(ErrImageReferenced, err)
+
+	os.MkdirAll(repo.Dir, 0755)
+	_, err = store.Restore(item.Id, &TagHistoryEntry{})
+	t.Equal(ErrRestoreConflict, err)
+
+	os.Remove(repo.Dir)
+	_, err = store.Restore(item.Id, &TagHistoryEntry{})
+	t.Nil(err)
+	t.Equal(1, len(repo.Tags()))
+}
+
+func (t *testSuite) TestTrashEndpoints() {
+	h := NewHandler(copyFixtures(), "dynport", NewBasicAuth(NewSingleUserStore("pass"), "secret"))
+	ser := httptest.NewServer(h)
+	defer ser.Close()
+
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, ser.URL+path, nil)
+		req.SetBasicAuth("mark", "pass")
+		rsp, _ := http.DefaultClient.Do(req)
+		return rsp
+	}
+
+	t.Equal(409, do("DELETE", "/v1/images/e0acc436/").StatusCode)
+	t.Equal(200, do("DELETE", "/v1/repositories/dynport/redis/tags/latest").StatusCode)
+	t.Equal(404, do("DELETE", "/v1/repositories/dynport/missing/").StatusCode)
+
+	// the trashed tag still refers to the image
+	t.Equal(409, do("DELETE", "/v1/images/e0acc436/").StatusCode)
+
+	rsp := do("GET", "/v1/_admin/trash")
+	t.Equal(200, rsp.StatusCode)
+	items := []*TrashItem{}
+	json.NewDecoder(rsp.Body).Decode(&items)
+	t.Equal(1, len(items))
+	t.Equal(TrashTag, items[0].Kind)
+	t.Equal("mark", items[0].DeletedBy)
+
+	t.Equal(200, do("POST", "/v1/_admin/trash/"+items[0].Id+"/_restore").StatusCode)
+	t.Equal(404, do("POST", "/v1/_admin/trash/"+items[0].Id+"/_restore").StatusCode)
+	t.Equal(200, do("GET", "/v1/repositories/dynport/redis/tags/latest").StatusCode)
+
+	// once purged from the trash nothing holds on to the image
+	t.Equal(200, do("DELETE", "/v1/repositories/dynport/redis/tags/latest").StatusCode)
+	h.store().GC(time.Hour, 0, false)
+	t.Equal(200, do("DELETE", "/v1/images/e0acc436/").StatusCode)
+	t.Equal(404, do("GET", "/v1/images/e0acc436/json").StatusCode)
+
+	items, _ = h.store().Trash()
+	t.Equal(1, len(items))
+	t.Equal(200, do("POST", "/v1/_admin/trash/"+items[0].Id+"/_restore").StatusCode)
+	t.Equal(200, do("GET", "/v1/images/e0acc436/json").StatusCode)
+
+	out := &bytes.Buffer{}
+	t.Nil(runCommand(h.store(), out, []string{"trash", "list"}))
+	t.Equal("", out.String())
+}
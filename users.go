@@ -2,13 +2,17 @@ package main
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -36,20 +40,46 @@ type UserAuth interface {
 	CheckAuth(r *http.Request) (*Session, error)
 }
 
+const (
+	defaultSessionTTL  = 24 * time.Hour
+	defaultMaxSessions = 10
+)
+
+// Session is made by logging in, with a password or an access token. The
+// sessions of access tokens carry the token's id and scopes.
 type Session struct {
-	Login, Token string
-	Status       int
+	Login    string        `json:"login"`
+	Token    string        `json:"token"`
+	IssuedAt time.Time     `json:"issued_at"`
+	TokenId  string        `json:"token_id,omitempty"`
+	Scopes   []*TokenScope `json:"scopes,omitempty"`
+	Status   int           `json:"-"`
 }
 
+// BasicAuth exchanges a login for a session token, keeping the sessions in
+// Sessions so any replica sharing it accepts the token. Sessions expire
+// after TTL and each login holds at most MaxSessions, logging in again
+// beyond that ends the oldest. Sessions in Revocations are refused. Access
+// tokens from Tokens are accepted as passwords.
 type BasicAuth struct {
 	sync.Mutex
-	Users    UserStore
-	Secret   string
-	sessions []*Session
+	Users       UserStore
+	Secret      string
+	Sessions    SessionStore
+	Revocations *Revocations
+	Tokens      *AccessTokens
+	TTL         time.Duration
+	MaxSessions int
 }
 
-func NewBasicAuth(users UserStore, secret string) UserAuth {
-	return &BasicAuth{Users: users, Secret: secret, sessions: []*Session{}}
+func NewBasicAuth(users UserStore, secret string) *BasicAuth {
+	return &BasicAuth{
+		Users:       users,
+		Secret:      secret,
+		Sessions:    NewMemorySessionStore(),
+		TTL:         defaultSessionTTL,
+		MaxSessions: defaultMaxSessions,
+	}
 }
 
 //
@@ -83,9 +113,19 @@ func (a *BasicAuth) checkBasicHeader(s []string) (*Session, error) {
 		return nil, errors.New("failed to decode basic auth header")
 	}
 
+	if a.Tokens != nil && isAccessToken(pair[1]) {
+		token, err := a.Tokens.Authenticate(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		session := &Session{Login: pair[0], Token: a.generateToken(pair[0]), IssuedAt: time.Now(), Status: SessionNew}
+		session.TokenId, session.Scopes = token.Id, token.Scopes
+		return session, a.addSession(session)
+	}
+
 	if a.Users.Auth(pair[0], pair[1]) {
-		session := &Session{pair[0], a.generateToken(pair[0]), SessionNew}
-		return a.addSession(session), nil
+		session := &Session{Login: pair[0], Token: a.generateToken(pair[0]), IssuedAt: time.Now(), Status: SessionNew}
+		return session, a.addSession(session)
 	}
 
 	return nil, errors.New("failed to decode basic auth header")
@@ -96,29 +136,137 @@ func (a *BasicAuth) checkTokenHeader(s []string) (*Session, error) {
 	return a.lookupSession(s[1])
 }
 
+// generateToken returns a fresh token for every session of login.
 func (a *BasicAuth) generateToken(login string) string {
 
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
 	mac := hmac.New(sha256.New, []byte(a.Secret))
 
 	mac.Write([]byte(login))
+	mac.Write(nonce)
 
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
 func (a *BasicAuth) lookupSession(token string) (*Session, error) {
-	for _, session := range a.sessions {
-		if session.Token == token {
-			session.Status = SessionExisting
-			return session, nil
+	session, ok := a.FindSession(token)
+	if !ok {
+		return nil, errors.New("Session not found")
+	}
+	session.Status = SessionExisting
+	return session, nil
+}
+
+// FindSession returns the session for token without marking it as used.
+func (a *BasicAuth) FindSession(token string) (*Session, bool) {
+	data, ok, err := a.Sessions.Get("session:" + token)
+	if err != nil {
+		logger.Errorf("looking up session %s", err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		logger.Errorf("decoding session %s", err)
+		return nil, false
+	}
+	if a.Revocations != nil && a.Revocations.Revoked(session) {
+		return nil, false
+	}
+	// deleting or expiring a token ends its sessions
+	if session.TokenId != "" && (a.Tokens == nil || !a.Tokens.Active(session.TokenId)) {
+		return nil, false
+	}
+	return session, true
+}
+
+// FindLogin returns the login a request authenticates as, by session token
+// or by checking its basic credentials without starting a session.
+func (a *BasicAuth) FindLogin(r *http.Request) (string, bool) {
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) == 2 && s[0] == "Token" {
+		if session, ok := a.FindSession(s[1]); ok {
+			return session.Login, true
 		}
+		return "", false
 	}
 
-	return nil, errors.New("Session not found")
+	login, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if a.Tokens != nil && isAccessToken(password) {
+		_, err := a.Tokens.Authenticate(login, password)
+		return login, err == nil
+	}
+	return login, a.Users.Auth(login, password)
 }
 
-func (a *BasicAuth) addSession(session *Session) *Session {
+// addSession stores session under its token and records it against its
+// login, ending the login's oldest sessions once it has more than
+// MaxSessions. The per-login list is only serialised within this process,
+// replicas sharing a redis may briefly let a login go over.
+func (a *BasicAuth) addSession(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := a.Sessions.Set("session:"+session.Token, data, a.TTL); err != nil {
+		return err
+	}
+
 	a.Lock()
 	defer a.Unlock()
-	a.sessions = append(a.sessions, session)
-	return session
+
+	sessions, err := a.loginSessions(session.Login)
+	if err != nil {
+		return err
+	}
+	sessions = append(sessions, &Session{Token: session.Token, IssuedAt: session.IssuedAt})
+
+	if a.MaxSessions > 0 && len(sessions) > a.MaxSessions {
+		sort.SliceStable(sessions, func(i, j int) bool {
+			return sessions[i].IssuedAt.Before(sessions[j].IssuedAt)
+		})
+		for _, old := range sessions[:len(sessions)-a.MaxSessions] {
+			if err := a.Sessions.Delete("session:" + old.Token); err != nil {
+				return err
+			}
+		}
+		sessions = sessions[len(sessions)-a.MaxSessions:]
+	}
+
+	if data, err = json.Marshal(sessions); err != nil {
+		return err
+	}
+	return a.Sessions.Set("login-sessions:"+session.Login, data, a.TTL)
+}
+
+// loginSessions returns the tokens and issue times of the sessions of login
+// which haven't expired yet.
+func (a *BasicAuth) loginSessions(login string) ([]*Session, error) {
+	data, ok, err := a.Sessions.Get("login-sessions:" + login)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	all := []*Session{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	sessions := []*Session{}
+	for _, session := range all {
+		if a.TTL <= 0 || time.Since(session.IssuedAt) < a.TTL {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func basicAuthRequest(login, password string) *http.Request {
+	r := &http.Request{Header: http.Header{}}
+	r.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(login+":"+password)))
+	return r
+}
+
+func tokenRequest(token string) *http.Request {
+	r := &http.Request{Header: http.Header{}}
+	r.Header.Set("Authorization", "Token "+token)
+	return r
+}
+
+func (t *testSuite) TestSessionTokensAreUnique() {
+	auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+
+	first, err := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	t.Nil(err)
+	second, err := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	t.Nil(err)
+	t.True(first.Token != second.Token)
+}
+
+func (t *testSuite) TestSessionExpiry() {
+	auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+	auth.TTL = 20 * time.Millisecond
+
+	session, err := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+	t.Nil(err)
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.Nil(err)
+
+	time.Sleep(40 * time.Millisecond)
+	_, err = auth.CheckAuth(tokenRequest(session.Token))
+	t.True(err != nil)
+}
+
+func (t *testSuite) TestMaxSessionsPerLogin() {
+	auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+	auth.MaxSessions = 2
+
+	tokens := []string{}
+	for i := 0; i < 3; i++ {
+		session, err := auth.CheckAuth(basicAuthRequest("mark", "pass"))
+		t.Nil(err)
+		tokens = append(tokens, session.Token)
+	}
+	other, err := auth.CheckAuth(basicAuthRequest("tim", "pass"))
+	t.Nil(err)
+
+	_, err = auth.CheckAuth(tokenRequest(tokens[0]))
+	t.True(err != nil)
+	for _, token := range append(tokens[1:], other.Token) {
+		_, err = auth.CheckAuth(tokenRequest(token))
+		t.Nil(err)
+	}
+}
+
+func (t *testSuite) TestMemorySessionStoreEvict() {
+	store := NewMemorySessionStore()
+	store.Set("a", []byte("1"), time.Millisecond)
+	store.Set("b", []byte("2"), 0)
+
+	time.Sleep(5 * time.Millisecond)
+	t.Equal(1, store.Evict())
+	_, ok, _ := store.Get("b")
+	t.True(ok)
+}
+
+func (t *testSuite) TestConcurrentAuth() {
+	auth := NewBasicAuth(NewSingleUserStore("pass"), "secret")
+	store := auth.Sessions.(*MemorySessionStore)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(login string) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				session, err := auth.CheckAuth(basicAuthRequest(login, "pass"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				found, err := auth.CheckAuth(tokenRequest(session.Token))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if found.Login != login || found.Status != SessionExisting {
+					errs <- fmt.Errorf("token of %s found %s", login, found.Login)
+				}
+				store.Evict()
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Nil(err)
+	}
+	for i := 0; i < 10; i++ {
+		sessions, err := auth.loginSessions(fmt.Sprintf("user%d", i))
+		t.Nil(err)
+		t.Equal(auth.MaxSessions, len(sessions))
+	}
+}
@@ -1,32 +1,197 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-func writeFile(path string, r io.ReadCloser) (e error) {
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize reads a byte count with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := strings.TrimLeft(s, "0123456789.")
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSuffix(s, unit), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func nopCloser(data []byte) io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func fileSize(path string) int64 {
+	if stat, err := os.Stat(path); err == nil {
+		return stat.Size()
+	}
+	return 0
+}
+
+// ErrObjectExists is returned when an object which is only ever written once
+// already holds different content.
+var ErrObjectExists = errors.New("object already exists with different content")
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+var pathLocks = struct {
+	sync.Mutex
+	locks map[string]*pathLock
+}{locks: make(map[string]*pathLock)}
+
+// lockPath serialises changes to the object at path, returning the function
+// which releases it.
+func lockPath(path string) func() {
+	pathLocks.Lock()
+	lock, ok := pathLocks.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		pathLocks.locks[path] = lock
+	}
+	lock.refs++
+	pathLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		pathLocks.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(pathLocks.locks, path)
+		}
+		pathLocks.Unlock()
+	}
+}
+
+// writeFile replaces the file at path with the content of r, the last
+// writer wins.
+func writeFile(path string, r io.ReadCloser) error {
+	tmpName, _, err := writeTemp(path, r)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockPath(path)
+	defer unlock()
+	return commitTemp(tmpName, path)
+}
+
+// writeFileOnce stores the content of r at path unless a file is already
+// there, in which case identical content is accepted as a no-op and anything
+// else fails with ErrObjectExists.
+func writeFileOnce(path string, r io.ReadCloser) error {
+	tmpName, sum, err := writeTemp(path, r)
+	if err != nil {
+		return err
+	}
+	return commitTempOnce(tmpName, sum, path)
+}
+
+// commitTempOnce moves a temporary file with checksum sum into place the way
+// writeFileOnce does.
+func commitTempOnce(tmpName, sum, path string) error {
+	unlock := lockPath(path)
+	defer unlock()
+
+	if existing, err := os.Open(path); err == nil {
+		defer existing.Close()
+		defer os.Remove(tmpName)
+
+		existingSum, err := readChecksum(existing)
+		if err != nil {
+			return err
+		}
+		if existingSum != sum {
+			return ErrObjectExists
+		}
+		logger.Info("identical content already at ", path)
+		return nil
+	}
+	return commitTemp(tmpName, path)
+}
+
+// writeTemp copies r into a temporary file of its own next to path, synced
+// to disk, returning its name and the checksum of the content.
+func writeTemp(path string, r io.ReadCloser) (tmpName, sum string, err error) {
 	started := time.Now()
 	logger.Info("writing to ", path)
-	e = os.MkdirAll(filepath.Dir(path), 0755)
-	if e != nil {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return
 	}
 
-	tmpName := path + ".tmp"
-	out, e := os.Create(tmpName)
-	if e != nil {
+	out, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
 		return
 	}
-	defer out.Close()
-	cnt, e := io.Copy(out, r)
-	if e != nil {
+	tmpName = out.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+
+	hash := sha256.New()
+	cnt, err := io.Copy(io.MultiWriter(out, hash), r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logger.Warnf("abandoned write to %s after %d bytes: %s", path, cnt, err)
 		return
 	}
+
 	logger.Info(fmt.Sprintf("Wrote %d bytes in %.06f", cnt, time.Now().Sub(started).Seconds()))
-	e = os.Rename(tmpName, path)
-	return
+	return tmpName, hashString(hash.Sum(nil)), nil
+}
+
+// isTempFile is true for the names writeTemp gives temporary files, which
+// start with a dot so they can't be mistaken for a tag.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")
+}
+
+// commitTemp renames the temporary file into place and syncs the directory
+// so the rename survives a crash.
+func commitTemp(tmpName, path string) error {
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
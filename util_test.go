@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+func (t *testSuite) TestWriteFileConcurrently() {
+	path := filepath.Join(resetTmpDataDir(), "images", "abc", "layer")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- writeFile(path, nopCloser([]byte(fmt.Sprintf("content %02d", i))))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Nil(err)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	t.Equal(10, len(data))
+
+	leftover, _ := filepath.Glob(filepath.Dir(path) + "/*.tmp")
+	t.Equal(0, len(leftover))
+	t.Equal(0, len(pathLocks.locks))
+}
+
+func (t *testSuite) TestWriteFileOnce() {
+	path := filepath.Join(resetTmpDataDir(), "images", "abc", "json")
+
+	t.Nil(writeFileOnce(path, nopCloser([]byte(`{"id":"abc"}`))))
+	t.Nil(writeFileOnce(path, nopCloser([]byte(`{"id":"abc"}`))))
+	t.Equal(ErrObjectExists, writeFileOnce(path, nopCloser([]byte(`{"id":"other"}`))))
+
+	data, _ := ioutil.ReadFile(path)
+	t.Equal(`{"id":"abc"}`, string(data))
+
+	leftover, _ := filepath.Glob(filepath.Dir(path) + "/*.tmp")
+	t.Equal(0, len(leftover))
+}
+
+func (t *testSuite) TestTagsSkipTemporaryFiles() {
+	repo := &Repository{filepath.Join(resetTmpDataDir(), "repositories", "dynport", "test")}
+	writeFile(repo.TagPath("latest"), nopCloser([]byte(`"abc"`)))
+	ioutil.WriteFile(repo.TagPath(".latest.1234.tmp"), []byte(`"def"`), 0644)
+	// a tag may well end in .tmp
+	writeFile(repo.TagPath("v1.tmp"), nopCloser([]byte(`"ghi"`)))
+
+	t.Equal(map[string]string{"latest": "abc", "v1.tmp": "ghi"}, repo.Tags())
+}